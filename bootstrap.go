@@ -0,0 +1,275 @@
+package ucloud
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/docker/machine/libmachine/log"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// hostKeyFile is the host key of uhost recorded in the machine directory at
+// the first bootstrap SSH connection
+const hostKeyFile = "host_key"
+
+// keyProbeTimeout is the timeout of checking whether the machine key is
+// installed
+const keyProbeTimeout = 10 * time.Second
+
+// authorizedKeysPath is the authorized_keys relative to the home directory
+const authorizedKeysPath = ".ssh/authorized_keys"
+
+// keyUploadFile is the public key written to the home directory of the
+// bootstrap user, it is installed for the other user with sudo
+const keyUploadFile = ".docker-machine-key.pub"
+
+var errHostKeyMismatch = errors.New("host key mismatch")
+
+// commandRunner run the command on uhost and get the output
+type commandRunner interface {
+	Output(command string) (string, error)
+}
+
+// bootstrapClient run the commands on uhost as the bootstrap user with the
+// password, a connection is made for every command like the native SSH client
+// of docker-machine
+type bootstrapClient struct {
+	addr    string
+	config  *ssh.ClientConfig
+	hostKey *hostKeyChecker // nil if the host key is not verified
+}
+
+func (d *Driver) newBootstrapClient(user, host string, port int) *bootstrapClient {
+	c := &bootstrapClient{
+		addr: net.JoinHostPort(host, strconv.Itoa(port)),
+		config: &ssh.ClientConfig{
+			User:            user,
+			Auth:            []ssh.AuthMethod{ssh.Password(d.Password)},
+			HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+			Timeout:         defaultTimeout,
+		},
+	}
+
+	if d.VerifyHostKey {
+		c.hostKey = &hostKeyChecker{path: d.ResolveStorePath(hostKeyFile)}
+		c.config.HostKeyCallback = c.hostKey.check
+	}
+
+	return c
+}
+
+func (c *bootstrapClient) Output(command string) (string, error) {
+	client, err := ssh.Dial("tcp", c.addr, c.config)
+	if err != nil {
+		return "", err
+	}
+	defer client.Close()
+
+	session, err := client.NewSession()
+	if err != nil {
+		return "", err
+	}
+	defer session.Close()
+
+	output, err := session.CombinedOutput(command)
+	return string(output), err
+}
+
+// installKey install the public key for user with SFTP, so the key is never
+// quoted by the shell of uhost. The authorized_keys of root is written by the
+// root bootstrap user directly, the key of the other users is written to
+// keyUploadFile and installed by authorizedKeysFileCommand.
+func (c *bootstrapClient) installKey(user, publicKey string) error {
+	client, err := ssh.Dial("tcp", c.addr, c.config)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	sftpClient, err := sftp.NewClient(client)
+	if err != nil {
+		return fmt.Errorf("start SFTP session failed:%w", err)
+	}
+	defer sftpClient.Close()
+
+	if c.config.User == "root" && user == "root" {
+		return writeAuthorizedKey(sftpClient, publicKey)
+	}
+
+	home, err := sftpClient.Getwd()
+	if err != nil {
+		return fmt.Errorf("get home directory failed:%w", err)
+	}
+	keyFile := path.Join(home, keyUploadFile)
+	if err := writeSFTPFile(sftpClient, keyFile, []byte(strings.TrimSpace(publicKey)+"\n")); err != nil {
+		return fmt.Errorf("write %s failed:%w", keyFile, err)
+	}
+
+	session, err := client.NewSession()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	command := authorizedKeysFileCommand(user, keyFile)
+	log.Debugf("Install the public key with command: %s", command)
+	if output, err := session.CombinedOutput(rootCommand(c.config.User, command)); err != nil {
+		return fmt.Errorf("install public key failed:%w: %s", err, output)
+	}
+
+	return nil
+}
+
+// writeAuthorizedKey append the public key to authorized_keys of the SFTP
+// user if it does not have the key, the file is replaced by rename so it is
+// never left truncated
+func writeAuthorizedKey(c *sftp.Client, publicKey string) error {
+	if err := c.MkdirAll(path.Dir(authorizedKeysPath)); err != nil {
+		return fmt.Errorf("create .ssh failed:%w", err)
+	}
+	if err := c.Chmod(path.Dir(authorizedKeysPath), 0700); err != nil {
+		return fmt.Errorf("chmod .ssh failed:%w", err)
+	}
+
+	existing, err := readSFTPFile(c, authorizedKeysPath)
+	if err != nil {
+		return fmt.Errorf("read %s failed:%w", authorizedKeysPath, err)
+	}
+	content, changed := appendAuthorizedKey(existing, publicKey)
+	if !changed {
+		return nil
+	}
+
+	tmp := authorizedKeysPath + ".tmp"
+	if err := writeSFTPFile(c, tmp, content); err != nil {
+		return fmt.Errorf("write %s failed:%w", tmp, err)
+	}
+	if err := c.PosixRename(tmp, authorizedKeysPath); err != nil {
+		c.Remove(tmp)
+		return fmt.Errorf("replace %s failed:%w", authorizedKeysPath, err)
+	}
+
+	return nil
+}
+
+// readSFTPFile read the file with SFTP, it is empty if the file does not exist
+func readSFTPFile(c *sftp.Client, name string) ([]byte, error) {
+	f, err := c.Open(name)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return ioutil.ReadAll(f)
+}
+
+// writeSFTPFile write the file with SFTP, only the owner can read it
+func writeSFTPFile(c *sftp.Client, name string, content []byte) error {
+	f, err := c.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
+	if err != nil {
+		return err
+	}
+	if err := c.Chmod(name, 0600); err != nil {
+		f.Close()
+		return err
+	}
+	if _, err := f.Write(content); err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
+
+// appendAuthorizedKey append the public key to the content of authorized_keys,
+// it is false if the content has the key already
+func appendAuthorizedKey(existing []byte, publicKey string) ([]byte, bool) {
+	key := strings.TrimSpace(publicKey)
+	for _, line := range strings.Split(string(existing), "\n") {
+		if strings.TrimSpace(line) == key {
+			return existing, false
+		}
+	}
+
+	content := make([]byte, 0, len(existing)+len(key)+2)
+	content = append(content, existing...)
+	if len(content) > 0 && content[len(content)-1] != '\n' {
+		content = append(content, '\n')
+	}
+	return append(content, key+"\n"...), true
+}
+
+// keyClient get the client logging in the uhost with the machine key, it is
+// false if the key is not installed yet
+func (d *Driver) keyClient(host string, port int) (*bootstrapClient, bool) {
+	key, err := ioutil.ReadFile(d.GetSSHKeyPath())
+	if err != nil {
+		return nil, false
+	}
+	signer, err := ssh.ParsePrivateKey(key)
+	if err != nil {
+		return nil, false
+	}
+
+	// the probe must not delay the upload to the new uhost much
+	c := d.newBootstrapClient(d.GetSSHUsername(), host, port)
+	c.config.Auth = []ssh.AuthMethod{ssh.PublicKeys(signer)}
+	c.config.Timeout = keyProbeTimeout
+	if _, err := c.Output("exit 0"); err != nil {
+		log.Debugf("login with the machine key failed:%s", err)
+		return nil, false
+	}
+
+	return c, true
+}
+
+// rejected get the error if the host key of uhost is rejected, there is no
+// point to retry the connection then
+func (c *bootstrapClient) rejected() error {
+	if c.hostKey == nil {
+		return nil
+	}
+	return c.hostKey.err
+}
+
+// hostKeyChecker trust the host key of uhost on first use and record it in
+// path, the later connections must present the same key
+type hostKeyChecker struct {
+	path string
+	err  error // the mismatch error
+}
+
+func (c *hostKeyChecker) check(hostname string, remote net.Addr, key ssh.PublicKey) error {
+	known, err := ioutil.ReadFile(c.path)
+	if os.IsNotExist(err) {
+		log.Infof("Trusting the host key %s of %s on first use", ssh.FingerprintSHA256(key), hostname)
+		return ioutil.WriteFile(c.path, ssh.MarshalAuthorizedKey(key), 0600)
+	}
+	if err != nil {
+		return fmt.Errorf("read host key failed:%w", err)
+	}
+
+	knownKey, _, _, _, err := ssh.ParseAuthorizedKey(known)
+	if err != nil {
+		return fmt.Errorf("parse host key %s failed:%w", c.path, err)
+	}
+	if !bytes.Equal(knownKey.Marshal(), key.Marshal()) {
+		c.err = fmt.Errorf("%w: %s presents %s, but %s is recorded in %s", errHostKeyMismatch,
+			hostname, ssh.FingerprintSHA256(key), ssh.FingerprintSHA256(knownKey), c.path)
+		return c.err
+	}
+
+	return nil
+}
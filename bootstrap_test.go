@@ -0,0 +1,61 @@
+package ucloud
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+type fakePublicKey string
+
+func (k fakePublicKey) Type() string    { return "ssh-ed25519" }
+func (k fakePublicKey) Marshal() []byte { return []byte(k) }
+
+func TestHostKeyChecker(t *testing.T) {
+	c := &hostKeyChecker{path: filepath.Join(t.TempDir(), hostKeyFile)}
+
+	if err := c.check("10.10.0.2:22", nil, fakePublicKey("key")); err != nil {
+		t.Fatalf("the host key should be trusted on first use, got:%s", err)
+	}
+	if c.err != nil {
+		t.Errorf("the first key should not be rejected, got:%s", c.err)
+	}
+}
+
+func TestBootstrapClientRejected(t *testing.T) {
+	d, _ := newFakeDriver(t)
+	c := d.newBootstrapClient("root", "127.0.0.1", 22)
+	if c.hostKey != nil || c.rejected() != nil {
+		t.Errorf("the host key should not be verified by default")
+	}
+
+	d.VerifyHostKey = true
+	c = d.newBootstrapClient("root", "127.0.0.1", 22)
+	if c.hostKey == nil {
+		t.Fatalf("the host key should be verified")
+	}
+	c.hostKey.err = errHostKeyMismatch
+	if err := c.rejected(); !errors.Is(err, errHostKeyMismatch) {
+		t.Errorf("expected error:%s, got:%v", errHostKeyMismatch, err)
+	}
+}
+
+func TestAppendAuthorizedKey(t *testing.T) {
+	content, changed := appendAuthorizedKey(nil, "ssh-rsa AAAA$'\"`x\n")
+	if !changed || string(content) != "ssh-rsa AAAA$'\"`x\n" {
+		t.Errorf("the key should be written as is, got:%q", content)
+	}
+
+	existing := []byte("ssh-rsa BBBB")
+	content, changed = appendAuthorizedKey(existing, "ssh-rsa AAAA")
+	if !changed || string(content) != "ssh-rsa BBBB\nssh-rsa AAAA\n" {
+		t.Errorf("the key should be appended in a new line, got:%q", content)
+	}
+	if string(existing) != "ssh-rsa BBBB" {
+		t.Errorf("the existing content should not be changed, got:%q", existing)
+	}
+
+	if _, changed := appendAuthorizedKey(content, "ssh-rsa AAAA\n"); changed {
+		t.Errorf("the installed key should not be appended again")
+	}
+}
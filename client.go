@@ -1,81 +1,508 @@
 package ucloud
 
 import (
+	"context"
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 
+	"github.com/docker/machine/libmachine/drivers"
 	"github.com/docker/machine/libmachine/log"
 	"github.com/docker/machine/libmachine/mcnutils"
 	"github.com/docker/machine/libmachine/ssh"
 	"github.com/docker/machine/version"
+	"github.com/ucloud/ucloud-sdk-go/service/uaccount"
+	"github.com/ucloud/ucloud-sdk-go/service/udisk"
 	"github.com/ucloud/ucloud-sdk-go/service/uhost"
+	"github.com/ucloud/ucloud-sdk-go/service/ulb"
+	"github.com/ucloud/ucloud-sdk-go/service/umon"
 	"github.com/ucloud/ucloud-sdk-go/service/unet"
+	"github.com/ucloud/ucloud-sdk-go/service/vpc"
 	"github.com/ucloud/ucloud-sdk-go/ucloud"
 	"github.com/ucloud/ucloud-sdk-go/ucloud/auth"
 )
 
-var (
-	hostsvc *uhost.UHost
-	unetsvc *unet.UNet
-)
+// ucloudClient is the UCloud API operations of the uhost lifecycle, Driver
+// implements it with the SDK and the tests inject a fake one
+type ucloudClient interface {
+	ensureVPC(ctx context.Context) error
+	createUHost(ctx context.Context) error
+	prepareUNet(ctx context.Context) (preparedUNet, error)
+	createUNet(ctx context.Context) error
+	getHostDescription(ctx context.Context) (*UHostDetail, error)
+	startUHost(ctx context.Context) error
+	stopUHost(ctx context.Context) error
+	terminateUHost(ctx context.Context) error
+	rebootUHost(ctx context.Context) error
+	killUHost(ctx context.Context) error
+}
+
+// api get the injected client, the driver itself is used by default
+func (d *Driver) api() ucloudClient {
+	if d.client != nil {
+		return d.client
+	}
+	return d
+}
+
+// contextTransport send the API requests with the context of the call, so
+// they are canceled when the call times out or its caller gives up
+type contextTransport struct {
+	ctx       context.Context
+	transport http.RoundTripper
+}
+
+func (t *contextTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return t.transport.RoundTrip(req.WithContext(t.ctx))
+}
+
+// newConfig get the SDK config of the API requests sent with ctx, the
+// transport is shared so the connections are reused across the calls
+func (d *Driver) newConfig(ctx context.Context) *ucloud.Config {
+	transport := d.transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
 
-func (d *Driver) newConfig() *ucloud.Config {
 	return &ucloud.Config{
 		Credentials: &auth.KeyPair{
-			PublicKey:  d.PublicKey,
-			PrivateKey: d.PrivateKey,
+			PublicKey:     d.PublicKey,
+			PrivateKey:    d.PrivateKey,
+			SecurityToken: d.SecurityToken,
 		},
-		Region: d.Region,
+		Region:    d.Region,
+		ProjectID: d.ProjectId,
+		BaseUrl:   d.APIEndpoint,
 		HTTPHeader: map[string]string{
 			"User-Agent": "docker-machine/" + version.Version,
 		},
+		HTTPClient: &http.Client{Transport: &contextTransport{ctx: ctx, transport: transport}},
+	}
+}
+
+func (d *Driver) getUHostService(ctx context.Context) *uhost.UHost {
+	return uhost.New(d.newConfig(ctx))
+}
+
+func (d *Driver) getUNetService(ctx context.Context) *unet.UNet {
+	return unet.New(d.newConfig(ctx))
+}
+
+func (d *Driver) getUAccountService(ctx context.Context) *uaccount.UAccount {
+	return uaccount.New(d.newConfig(ctx))
+}
+
+func (d *Driver) getUDiskService(ctx context.Context) *udisk.UDisk {
+	return udisk.New(d.newConfig(ctx))
+}
+
+func (d *Driver) getVPCService(ctx context.Context) *vpc.VPC {
+	return vpc.New(d.newConfig(ctx))
+}
+
+func (d *Driver) getULBService(ctx context.Context) *ulb.ULB {
+	return ulb.New(d.newConfig(ctx))
+}
+
+func (d *Driver) getUMonService(ctx context.Context) *umon.UMon {
+	return umon.New(d.newConfig(ctx))
+}
+
+// getRegions get all the regions and zones from the GetRegion API
+func (d *Driver) getRegions(ctx context.Context) (map[string][]string, error) {
+	getRegionParams := uaccount.GetRegionParams{}
+	r, err := d.call(ctx, "GetRegion", &getRegionParams, func(ctx context.Context) (interface{}, error) {
+		return d.getUAccountService(ctx).GetRegion(&getRegionParams)
+	})
+	if err != nil {
+		return nil, err
+	}
+	resp := r.(*uaccount.GetRegionResponse)
+
+	if len(resp.Regions) == 0 {
+		return nil, fmt.Errorf("regions is empty")
+	}
+
+	regions := make(map[string][]string)
+	for _, r := range resp.Regions {
+		regions[r.Region] = append(regions[r.Region], r.Zone)
+	}
+
+	return regions, nil
+}
+
+const (
+	quotaUHostCPU    = "uhost_cpu"
+	quotaUHostMemory = "uhost_memory"
+	quotaEIP         = "eip"
+)
+
+// getQuotas get the available quotas of the resource types in region
+func (d *Driver) getQuotas(ctx context.Context, resourceTypes []string) (map[string]int, error) {
+	getQuotaParams := uaccount.GetQuotaParams{
+		Region:        d.Region,
+		ResourceTypes: resourceTypes,
+	}
+
+	r, err := d.call(ctx, "GetQuota", &getQuotaParams, func(ctx context.Context) (interface{}, error) {
+		return d.getUAccountService(ctx).GetQuota(&getQuotaParams)
+	})
+	if err != nil {
+		return nil, err
+	}
+	resp := r.(*uaccount.GetQuotaResponse)
+
+	quotas := make(map[string]int)
+	for _, q := range resp.QuotaSet {
+		quotas[q.ResourceType] = q.Available
+	}
+
+	return quotas, nil
+}
+
+// getMachineTypes get the available machine types of the zone of driver, all
+// zones in the region are included if zone is not set
+func (d *Driver) getMachineTypes(ctx context.Context) ([]string, error) {
+	params := uhost.DescribeAvailableInstanceTypesParams{
+		Region: d.Region,
+		Zone:   d.Zone,
+	}
+
+	r, err := d.call(ctx, "DescribeAvailableInstanceTypes", &params, func(ctx context.Context) (interface{}, error) {
+		return d.getUHostService(ctx).DescribeAvailableInstanceTypes(&params)
+	})
+	if err != nil {
+		return nil, err
+	}
+	resp := r.(*uhost.DescribeAvailableInstanceTypesResponse)
+
+	found := make(map[string]bool)
+	var machineTypes []string
+	for _, t := range resp.AvailableInstanceTypes {
+		if t.Status != "Normal" || found[t.Name] {
+			continue
+		}
+		found[t.Name] = true
+		machineTypes = append(machineTypes, t.Name)
+	}
+
+	if len(machineTypes) == 0 {
+		return nil, fmt.Errorf("no machine type available in region %s", d.Region)
+	}
+
+	return machineTypes, nil
+}
+
+// selectZone choose a zone in stock for the machine type, CPU cores and memory
+// of uhost if zone is not set
+func (d *Driver) selectZone(ctx context.Context) error {
+	if d.Zone != "" {
+		return nil
+	}
+
+	params := uhost.DescribeAvailableInstanceTypesParams{
+		Region: d.Region,
+	}
+	r, err := d.call(ctx, "DescribeAvailableInstanceTypes", &params, func(ctx context.Context) (interface{}, error) {
+		return d.getUHostService(ctx).DescribeAvailableInstanceTypes(&params)
+	})
+	if err != nil {
+		return err
+	}
+	resp := r.(*uhost.DescribeAvailableInstanceTypesResponse)
+
+	zone := zoneInStock(resp.AvailableInstanceTypes, d.MachineType, d.CPU, d.Memory)
+	if zone == "" {
+		return newError(ErrNoStock, "no zone in region %s has stock of UHost with %d CPU cores and %dMB memory", d.Region, d.CPU, d.Memory)
+	}
+	log.Infof("Zone %s is chosen for the UHost", zone)
+	d.Zone = zone
+
+	return nil
+}
+
+// zoneInStock get the first zone in name order which has stock of the machine
+// type with the CPU cores and memory(MB), any machine type is matched if it is
+// empty
+func zoneInStock(types []uhost.AvailableInstanceType, machineType string, cpu, memory int) string {
+	var zones []string
+	for _, t := range types {
+		if t.Status != "Normal" || (machineType != "" && t.Name != machineType) {
+			continue
+		}
+		if hasMachineSize(t.MachineSizes, cpu, memory) {
+			zones = append(zones, t.Zone)
+		}
+	}
+	if len(zones) == 0 {
+		return ""
+	}
+
+	sort.Strings(zones)
+	return zones[0]
+}
+
+// hasMachineSize check whether the CPU cores and memory(MB) is in the sizes,
+// the memory of sizes is in GB
+func hasMachineSize(sizes []uhost.MachineSizes, cpu, memory int) bool {
+	for _, size := range sizes {
+		if size.Gpu != 0 {
+			continue
+		}
+		for _, c := range size.Collection {
+			if c.Cpu != cpu {
+				continue
+			}
+			for _, m := range c.Memory {
+				if m*1024 == memory {
+					return true
+				}
+			}
+		}
+	}
+
+	return false
+}
+
+// Image is the UHost image which can be used by driver
+type Image struct {
+	Id     string
+	Name   string
+	OsType string
+	OsName string
+	Arch   string
+	State  string
+
+	CreateTime int // unix timestamp
+}
+
+// ListImages list the available base images in region, the tooling built on
+// driver can use it to discover the valid images
+func (d *Driver) ListImages(region string) ([]Image, error) {
+	return d.listImages(context.Background(), region)
+}
+
+// listImages list the available base images in region page by page
+func (d *Driver) listImages(ctx context.Context, region string) ([]Image, error) {
+	describeImageParams := uhost.DescribeImageParams{
+		Region:    region,
+		ImageType: "Base",
+		Limit:     100,
 	}
+
+	var images []Image
+	for {
+		r, err := d.call(ctx, "DescribeImage", &describeImageParams, func(ctx context.Context) (interface{}, error) {
+			return d.getUHostService(ctx).DescribeImage(&describeImageParams)
+		})
+		if err != nil {
+			return nil, err
+		}
+		resp := r.(*uhost.DescribeImageResponse)
+
+		for _, i := range resp.ImageSet {
+			if i.State != "Available" {
+				continue
+			}
+			images = append(images, Image{
+				Id:         i.ImageId,
+				Name:       i.ImageName,
+				OsType:     i.OsType,
+				OsName:     i.OsName,
+				Arch:       imageArch(i.OsName, i.ImageName),
+				State:      i.State,
+				CreateTime: i.CreateTime,
+			})
+		}
+
+		describeImageParams.Offset += len(resp.ImageSet)
+		if len(resp.ImageSet) == 0 || describeImageParams.Offset >= resp.TotalCount {
+			return images, nil
+		}
+	}
+}
+
+// getImage get the image of ImageId in region
+func (d *Driver) getImage(ctx context.Context) (*uhost.ImageSet, error) {
+	describeImageParams := uhost.DescribeImageParams{
+		Region:  d.Region,
+		Zone:    d.Zone,
+		ImageId: d.ImageId,
+	}
+
+	r, err := d.call(ctx, "DescribeImage", &describeImageParams, func(ctx context.Context) (interface{}, error) {
+		return d.getUHostService(ctx).DescribeImage(&describeImageParams)
+	})
+	if err != nil {
+		return nil, err
+	}
+	resp := r.(*uhost.DescribeImageResponse)
+
+	if len(resp.ImageSet) == 0 {
+		return nil, fmt.Errorf("image %s is not exist in region %s", d.ImageId, d.Region)
+	}
+
+	return &resp.ImageSet[0], nil
 }
 
-func (d *Driver) getUHostService() *uhost.UHost {
+// uhostDisks get the boot and data disks created with uhost
+func (d *Driver) uhostDisks() []uhost.UHostDisk {
+	var disks []uhost.UHostDisk
+
+	// boot disk must be set in disks when there is a data disk
+	if d.BootDiskType != "" || d.DataDiskSize > 0 {
+		bootDiskType := d.BootDiskType
+		if bootDiskType == "" {
+			bootDiskType = defaultDiskType
+		}
+		disks = append(disks, uhost.UHostDisk{
+			IsBoot: "True",
+			Type:   bootDiskType,
+			Size:   d.DiskSpace,
+		})
+	}
 
-	if hostsvc != nil {
-		return hostsvc
+	if d.DataDiskSize > 0 {
+		dataDiskType := d.DataDiskType
+		if dataDiskType == "" {
+			dataDiskType = defaultDiskType
+		}
+		disks = append(disks, uhost.UHostDisk{
+			IsBoot: "False",
+			Type:   dataDiskType,
+			Size:   d.DataDiskSize,
+		})
 	}
-	hostsvc = uhost.New(d.newConfig())
 
-	return hostsvc
+	return disks
 }
 
-func (d *Driver) getUNetService() *unet.UNet {
+// estimatePrice get the estimated price(CNY) per month of the uhost with its
+// disks and EIP, the traffic of EIP charged by traffic is not included
+func (d *Driver) estimatePrice(ctx context.Context) (float64, error) {
+	priceParams := uhost.GetUHostInstancePriceParams{
+		Region:      d.Region,
+		Zone:        d.Zone,
+		ImageId:     d.ImageId,
+		CPU:         d.CPU,
+		Memory:      d.Memory,
+		Count:       1,
+		ChargeType:  d.ChargeType,
+		Quantity:    1,
+		MachineType: d.MachineType,
+		Disks:       d.uhostDisks(),
+	}
+	r, err := d.call(ctx, "GetUHostInstancePrice", &priceParams, func(ctx context.Context) (interface{}, error) {
+		return d.getUHostService(ctx).GetUHostInstancePrice(&priceParams)
+	})
+	if err != nil {
+		return 0, fmt.Errorf("get UHost price failed:%w", err)
+	}
+	resp := r.(*uhost.GetUHostInstancePriceResponse)
+	if len(resp.PriceSet) == 0 {
+		return 0, fmt.Errorf("UHost price is empty")
+	}
+	price := monthlyPrice(resp.PriceSet[0].Price, d.ChargeType)
 
-	if unetsvc != nil {
-		return unetsvc
+	// the EIP is charged hourly by bandwidth
+	if !d.PrivateIPOnly && !d.ExistingEIP && d.ShareBandwidthId == "" && d.EIPChargeMode == "PayByBandwidth" {
+		eipPriceParams := unet.GetEIPPriceParams{
+			Region:       d.Region,
+			OperatorName: eipOperator(d.EIPOperator, d.Region),
+			Bandwidth:    d.EIPBandwidth,
+			ChargeType:   "Dynamic",
+			PayMode:      "Bandwidth",
+		}
+		r, err := d.call(ctx, "GetEIPPrice", &eipPriceParams, func(ctx context.Context) (interface{}, error) {
+			return d.getUNetService(ctx).GetEIPPrice(&eipPriceParams)
+		})
+		if err != nil {
+			return 0, fmt.Errorf("get EIP price failed:%w", err)
+		}
+		resp := r.(*unet.GetEIPPriceResponse)
+		if len(resp.PriceSet) == 0 {
+			return 0, fmt.Errorf("EIP price is empty")
+		}
+		price += monthlyPrice(resp.PriceSet[0].Price, "Dynamic")
 	}
-	unetsvc = unet.New(d.newConfig())
 
-	return unetsvc
+	return price, nil
 }
 
-func (d *Driver) createUHost() error {
+func (d *Driver) createUHost(ctx context.Context) error {
 	password := strings.Replace(base64.StdEncoding.EncodeToString([]byte(d.Password)), "=", "", -1)
 
 	createUhostParams := uhost.CreateUHostInstanceParams{
 
-		Region:     d.Region,
-		ImageId:    d.ImageId,
-		LoginMode:  "Password",
-		Password:   password,
-		CPU:        d.CPU,
-		Memory:     d.Memory,
-		DiskSpace:  d.DiskSpace,
-		Name:       d.MachineName,
-		ChargeType: d.ChargeType,
-		Quantity:   1,
-		Count:      1,
+		Region:         d.Region,
+		Zone:           d.Zone,
+		ImageId:        d.ImageId,
+		LoginMode:      "Password",
+		Password:       password,
+		CPU:            d.CPU,
+		Memory:         d.Memory,
+		DiskSpace:      d.DiskSpace,
+		Name:           d.MachineName,
+		HostName:       hostname(d.MachineName),
+		ChargeType:     d.ChargeType,
+		MachineType:    d.MachineType,
+		HotplugFeature: d.Hotplug,
+		NetCapability:  d.NetCapability,
+		VPCId:          d.VPCId,
+		SubnetId:       d.SubnetId,
+		Quantity:       d.ChargeDuration,
+		Count:          1,
+		CouponId:       d.CouponId,
+		Tag:            d.Tag,
+		Remark:         d.Remark,
+	}
+
+	// only prepaid uhost can be renewed
+	if d.AutoRenew && (d.ChargeType == "Year" || d.ChargeType == "Month") {
+		createUhostParams.AutoRenew = "Yes"
+	}
+
+	if d.StaticPrivateIP != "" {
+		createUhostParams.PrivateIp = []string{d.StaticPrivateIP}
 	}
 
-	resp, err := d.getUHostService().CreateUHostInstance(&createUhostParams)
+	createUhostParams.Disks = d.uhostDisks()
+
+	if d.UserDataFile != "" {
+		userdata, err := ioutil.ReadFile(d.UserDataFile)
+		if err != nil {
+			return fmt.Errorf("read user data file failed:%w", err)
+		}
+		createUhostParams.UserData = base64.StdEncoding.EncodeToString(userdata)
+	}
+	commands, err := d.bootCommands()
 	if err != nil {
 		return err
 	}
+	if len(commands) > 0 {
+		createUhostParams.UserData = base64.StdEncoding.EncodeToString([]byte(cloudConfig(commands)))
+	}
+
+	// the uhost created by the failed request is found by the machine name
+	r, err := d.create(ctx, "CreateUHostInstance", &createUhostParams, func(ctx context.Context) (interface{}, error) {
+		return d.getUHostService(ctx).CreateUHostInstance(&createUhostParams)
+	}, func(ctx context.Context) (interface{}, error) {
+		uhostId, err := d.findUHostByName(ctx)
+		if err != nil || uhostId == "" {
+			return nil, err
+		}
+		return &uhost.CreateUHostInstanceResponse{UHostIds: []string{uhostId}}, nil
+	})
+	if err != nil {
+		return d.createUHostError(err)
+	}
+	resp := r.(*uhost.CreateUHostInstanceResponse)
 
 	if resp == nil {
 		return fmt.Errorf("response is empty")
@@ -89,12 +516,14 @@ func (d *Driver) createUHost() error {
 	return nil
 }
 
-func (d *Driver) startUHost() error {
+func (d *Driver) startUHost(ctx context.Context) error {
 	startUhostParams := uhost.StartUHostInstanceParams{
 		Region:  d.Region,
 		UHostId: d.UhostID,
 	}
-	_, err := d.getUHostService().StartUHostInstance(&startUhostParams)
+	_, err := d.call(ctx, "StartUHostInstance", &startUhostParams, func(ctx context.Context) (interface{}, error) {
+		return d.getUHostService(ctx).StartUHostInstance(&startUhostParams)
+	})
 	if err != nil {
 		return err
 	}
@@ -102,13 +531,16 @@ func (d *Driver) startUHost() error {
 	return nil
 }
 
-func (d *Driver) killUHost() error {
+// killUHost power off the uhost without the ACPI shutdown
+func (d *Driver) killUHost(ctx context.Context) error {
 	killUHostParams := uhost.PoweroffUHostInstanceParams{
 		Region:  d.Region,
 		UHostId: d.UhostID,
 	}
 
-	_, err := d.getUHostService().PoweroffUHostInstance(&killUHostParams)
+	_, err := d.call(ctx, "PoweroffUHostInstance", &killUHostParams, func(ctx context.Context) (interface{}, error) {
+		return d.getUHostService(ctx).PoweroffUHostInstance(&killUHostParams)
+	})
 	if err != nil {
 		return err
 	}
@@ -116,43 +548,75 @@ func (d *Driver) killUHost() error {
 	return nil
 }
 
-func (d *Driver) rebootUHost() error {
+func (d *Driver) rebootUHost(ctx context.Context) error {
 
-	killUHostParams := uhost.PoweroffUHostInstanceParams{
+	rebootUHostParams := uhost.RebootUHostInstanceParams{
 		Region:  d.Region,
 		UHostId: d.UhostID,
 	}
 
-	_, err := d.getUHostService().PoweroffUHostInstance(&killUHostParams)
+	_, err := d.call(ctx, "RebootUHostInstance", &rebootUHostParams, func(ctx context.Context) (interface{}, error) {
+		return d.getUHostService(ctx).RebootUHostInstance(&rebootUHostParams)
+	})
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
-func (d *Driver) terminateUHost() error {
+func (d *Driver) terminateUHost(ctx context.Context) error {
 
 	terminateUHostParams := uhost.TerminateUHostInstanceParams{
 		Region:  d.Region,
 		UHostId: d.UhostID,
 	}
 
-	_, err := d.getUHostService().TerminateUHostInstance(&terminateUHostParams)
+	_, err := d.call(ctx, "TerminateUHostInstance", &terminateUHostParams, func(ctx context.Context) (interface{}, error) {
+		return d.getUHostService(ctx).TerminateUHostInstance(&terminateUHostParams)
+	})
 	if err != nil {
 		return err
 	}
 
-	// TODO: remove EIP and security group etc.
 	return nil
 }
 
-func (d *Driver) stopUHost() error {
+// uhostTerminatedFunc check whether the uhost is terminated
+func (d *Driver) uhostTerminatedFunc(ctx context.Context) func() bool {
+	return func() bool {
+		_, err := d.api().getHostDescription(ctx)
+		return errors.Is(err, errUHostNotExist)
+	}
+}
+
+func (d *Driver) stopUHost(ctx context.Context) error {
 	stopUhostParams := uhost.StopUHostInstanceParams{
 		Region:  d.Region,
 		UHostId: d.UhostID,
 	}
 
-	_, err := d.getUHostService().StopUHostInstance(&stopUhostParams)
+	_, err := d.call(ctx, "StopUHostInstance", &stopUhostParams, func(ctx context.Context) (interface{}, error) {
+		return d.getUHostService(ctx).StopUHostInstance(&stopUhostParams)
+	})
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (d *Driver) resizeUHost(ctx context.Context, cpu, memory, diskSpace int) error {
+	resizeUHostParams := uhost.ResizeUHostInstanceParams{
+		Region:    d.Region,
+		UHostId:   d.UhostID,
+		CPU:       cpu,
+		Memory:    memory,
+		DiskSpace: diskSpace,
+	}
+
+	_, err := d.call(ctx, "ResizeUHostInstance", &resizeUHostParams, func(ctx context.Context) (interface{}, error) {
+		return d.getUHostService(ctx).ResizeUHostInstance(&resizeUHostParams)
+	})
 	if err != nil {
 		return err
 	}
@@ -160,18 +624,92 @@ func (d *Driver) stopUHost() error {
 	return nil
 }
 
+// resetPassword reset the password of the stopped uhost
+func (d *Driver) resetPassword(ctx context.Context, password string) error {
+	resetParams := uhost.ResetUHostInstancePasswordParams{
+		Region:   d.Region,
+		UHostId:  d.UhostID,
+		Password: strings.Replace(base64.StdEncoding.EncodeToString([]byte(password)), "=", "", -1),
+	}
+
+	_, err := d.call(ctx, "ResetUHostInstancePassword", &resetParams, func(ctx context.Context) (interface{}, error) {
+		return d.getUHostService(ctx).ResetUHostInstancePassword(&resetParams)
+	})
+
+	return err
+}
+
+// createCustomImage create a custom image from the stopped uhost
+func (d *Driver) createCustomImage(ctx context.Context, name string) (string, error) {
+	createCustomImageParams := uhost.CreateCustomImageParams{
+		Region:           d.Region,
+		Zone:             d.Zone,
+		UHostId:          d.UhostID,
+		ImageName:        name,
+		ImageDescription: fmt.Sprintf("created by docker-machine from %s", d.MachineName),
+	}
+
+	r, err := d.call(ctx, "CreateCustomImage", &createCustomImageParams, func(ctx context.Context) (interface{}, error) {
+		return d.getUHostService(ctx).CreateCustomImage(&createCustomImageParams)
+	})
+	if err != nil {
+		return "", err
+	}
+	resp := r.(*uhost.CreateCustomImageResponse)
+
+	if resp.ImageId == "" {
+		return "", fmt.Errorf("ImageId is empty")
+	}
+
+	return resp.ImageId, nil
+}
+
+// imageAvailableFunc check whether the image becomes available
+func (d *Driver) imageAvailableFunc(ctx context.Context, imageId string) func() bool {
+	return func() bool {
+		describeImageParams := uhost.DescribeImageParams{
+			Region:  d.Region,
+			ImageId: imageId,
+		}
+		r, err := d.call(ctx, "DescribeImage", &describeImageParams, func(ctx context.Context) (interface{}, error) {
+			return d.getUHostService(ctx).DescribeImage(&describeImageParams)
+		})
+		if err != nil {
+			log.Debugf("describe image %s failed:%s", imageId, err)
+			return false
+		}
+		resp := r.(*uhost.DescribeImageResponse)
+
+		return len(resp.ImageSet) > 0 && resp.ImageSet[0].State == "Available"
+	}
+}
+
 type UHostDetail struct {
 	region string
+	zone   string
 	hostID string
+	disks  []UHostDisk
+
+	vpcId    string
+	subnetId string
+	mac      string // mac address of the primary network interface
 
 	state            string
 	publicIPAddress  string
 	privateIPAddress string
+	ipv6Address      string
 	cpu              int
 	memory           int
 }
 
-func (d *Driver) getHostDescription() (*UHostDetail, error) {
+// UHostDisk is the boot or data disk of uhost
+type UHostDisk struct {
+	id   string
+	kind string
+	size int
+}
+
+func (d *Driver) getHostDescription(ctx context.Context) (*UHostDetail, error) {
 
 	describeParams := uhost.DescribeUHostInstanceParams{
 		Region:   d.Region,
@@ -180,13 +718,16 @@ func (d *Driver) getHostDescription() (*UHostDetail, error) {
 		Limit:    10,
 	}
 
-	resp, err := d.getUHostService().DescribeUHostInstance(&describeParams)
+	r, err := d.call(ctx, "DescribeUHostInstance", &describeParams, func(ctx context.Context) (interface{}, error) {
+		return d.getUHostService(ctx).DescribeUHostInstance(&describeParams)
+	})
 	if err != nil {
 		return nil, err
 	}
+	resp := r.(*uhost.DescribeUHostInstanceResponse)
 
 	if len(resp.UHostSet) == 0 {
-		return nil, fmt.Errorf("UHost is not exist.")
+		return nil, errUHostNotExist
 	}
 
 	if len(resp.UHostSet[0].IPSet) == 0 {
@@ -195,164 +736,993 @@ func (d *Driver) getHostDescription() (*UHostDetail, error) {
 
 	var publicIpAddress string
 	var privateIPAddress string
+	var ipv6Address string
+	var vpcId, subnetId, mac string
 	for _, ip := range resp.UHostSet[0].IPSet {
 		switch ip.Type {
 		case "Private":
 			privateIPAddress = ip.IP
-		case "Bgp":
-			publicIpAddress = ip.IP
+			vpcId, subnetId, mac = ip.VPCId, ip.SubnetId, ip.Mac
+		case "IPv6":
+			ipv6Address = ip.IP
+		default:
+			// the type of public IP is the operator of EIP
+			if validateEIPOperator(ip.Type) == nil {
+				publicIpAddress = ip.IP
+			}
 		}
 	}
 
+	var disks []UHostDisk
+	for _, disk := range resp.UHostSet[0].DiskSet {
+		disks = append(disks, UHostDisk{
+			id:   disk.DiskId,
+			kind: disk.Type,
+			size: disk.Size,
+		})
+	}
+
 	d.CPU = resp.UHostSet[0].CPU
 	d.Memory = resp.UHostSet[0].Memory
 
 	return &UHostDetail{
 		region:           d.Region,
+		zone:             resp.UHostSet[0].Zone,
 		hostID:           resp.UHostSet[0].UHostId,
+		disks:            disks,
+		vpcId:            vpcId,
+		subnetId:         subnetId,
+		mac:              mac,
 		state:            resp.UHostSet[0].State,
 		publicIPAddress:  publicIpAddress,
 		privateIPAddress: privateIPAddress,
+		ipv6Address:      ipv6Address,
 		cpu:              resp.UHostSet[0].CPU,
 		memory:           resp.UHostSet[0].Memory,
 	}, nil
 }
 
-// createUNet create network for uhost
-func (d *Driver) createUNet() error {
-	if err := d.configureIPAddress(); err != nil {
-		return fmt.Errorf("configure IPAddress error:%s", err)
+// refreshIPAddress look up the public and private address of uhost, the EIP
+// is described if the public address is not in the uhost description
+func (d *Driver) refreshIPAddress(ctx context.Context) error {
+	hostDetails, err := d.api().getHostDescription(ctx)
+	if err != nil {
+		return fmt.Errorf("get host detail failed: %w", err)
 	}
+	d.PrivateIPAddress = hostDetails.privateIPAddress
 
-	if err := d.configureSecurityGroup(); err != nil {
-		return fmt.Errorf("configure security group error:%s", err)
+	if d.PrivateIPOnly {
+		return nil
 	}
 
-	return nil
-}
-
-// createKeyPair create keypair for ssh to docker-machine
-func (d *Driver) createKeyPair() error {
-	log.Debugf("SSH key path:%s", d.GetSSHKeyPath())
+	if hostDetails.publicIPAddress != "" {
+		d.IPAddress = hostDetails.publicIPAddress
+		return nil
+	}
 
-	if err := ssh.GenerateSSHKey(d.GetSSHKeyPath()); err != nil {
-		return err
+	if d.EIPId != "" {
+		ip, err := d.getEIPAddress(ctx, d.EIPId)
+		if err != nil {
+			return err
+		}
+		d.IPAddress = ip
 	}
 
 	return nil
 }
 
-func (d *Driver) waitForSSHFunc(client ssh.Client, command string) func() bool {
-	return func() bool {
-		_, err := client.Output(command)
-		if err == nil {
-			return true
-		}
-		return false
+// createUHostError get the error of the failed CreateUHostInstance, the sold
+// out response is reported with ErrNoStock
+func (d *Driver) createUHostError(err error) error {
+	var rc retCoder
+	if errors.As(err, &rc) && rc.RetCode() == retCodeNoStock {
+		return newError(ErrNoStock, "zone %s has no stock of UHost with %d CPU cores and %dMB memory: %s", d.Zone, d.CPU, d.Memory, err)
 	}
+
+	return err
 }
 
-// uploadKeyPair upload the public key to docker-machine
-func (d *Driver) uploadKeyPair() error {
+// findUHostByName find the uhost with the same name and tag of the machine,
+// empty id is returned if no uhost is found
+func (d *Driver) findUHostByName(ctx context.Context) (string, error) {
+	describeParams := uhost.DescribeUHostInstanceParams{
+		Region: d.Region,
+		Tag:    d.Tag,
+		Limit:  100,
+	}
 
-	ipAddr, err := d.GetIP()
-	if err != nil {
-		return err
+	for {
+		r, err := d.call(ctx, "DescribeUHostInstance", &describeParams, func(ctx context.Context) (interface{}, error) {
+			return d.getUHostService(ctx).DescribeUHostInstance(&describeParams)
+		})
+		if err != nil {
+			return "", err
+		}
+		resp := r.(*uhost.DescribeUHostInstanceResponse)
+
+		for _, host := range resp.UHostSet {
+			if host.Name == d.MachineName {
+				return host.UHostId, nil
+			}
+		}
+
+		describeParams.Offset += len(resp.UHostSet)
+		if len(resp.UHostSet) == 0 || describeParams.Offset >= resp.TotalCount {
+			return "", nil
+		}
 	}
+}
 
-	port, _ := d.GetSSHPort()
-	auth := ssh.Auth{
-		Passwords: []string{d.Password},
+// getZone get the zone of uhost, it is looked up from the uhost description
+// if zone is not set
+func (d *Driver) getZone(ctx context.Context) (string, error) {
+	if d.Zone != "" {
+		return d.Zone, nil
 	}
 
-	ssh.SetDefaultClient(ssh.Native)
-	sshClient, err := ssh.NewClient(d.GetSSHUsername(), ipAddr, port, &auth)
+	hostDetails, err := d.api().getHostDescription(ctx)
 	if err != nil {
-		return err
+		return "", fmt.Errorf("get host detail failed: %w", err)
 	}
-	d.waitForSSHFunc(sshClient, "exit 0")
+	d.Zone = hostDetails.zone
 
-	publicKey, err := ioutil.ReadFile(d.GetSSHKeyPath() + ".pub")
+	return d.Zone, nil
+}
+
+// recordDiskIds record the ids of disks created with uhost, the attached
+// udisks are excluded
+func (d *Driver) recordDiskIds(ctx context.Context) error {
+	hostDetails, err := d.api().getHostDescription(ctx)
 	if err != nil {
-		return err
+		return fmt.Errorf("get host detail failed: %w", err)
 	}
 
-	command := fmt.Sprintf("mkdir -p ~/.ssh; echo '%s' > ~/.ssh/authorized_keys", string(publicKey))
-	log.Debugf("Upload the public key with command: %s", command)
+	attached := make(map[string]bool)
+	for _, diskId := range d.UDiskIds {
+		attached[diskId] = true
+	}
 
-	output, err := sshClient.Output(command)
-	if err != nil {
-		log.Debugf("Upload command err, output: %v: %s", err, output)
-		return err
+	d.DiskIds = nil
+	for _, disk := range hostDetails.disks {
+		if !attached[disk.id] {
+			d.DiskIds = append(d.DiskIds, disk.id)
+		}
 	}
 
 	return nil
 }
 
-func (d *Driver) configureIPAddress() error {
+// dataDiskIds get the ids of data disks in disks, the attached udisks are
+// excluded
+func dataDiskIds(disks []UHostDisk, attached []string) []string {
+	excluded := make(map[string]bool)
+	for _, diskId := range attached {
+		excluded[diskId] = true
+	}
 
-	// create an EIP and bind it to host
-	if !d.PrivateIPOnly {
-		createEIPParams := unet.AllocateEIPParams{
-			Region:       d.Region,
-			OperatorName: "Bgp",
-			Bandwidth:    2,
-			ChargeType:   "Dynamic",
-			Quantity:     1,
+	var ids []string
+	for _, disk := range disks {
+		if disk.kind != "Boot" && !excluded[disk.id] {
+			ids = append(ids, disk.id)
 		}
+	}
+	return ids
+}
 
-		resp, err := d.getUNetService().AllocateEIP(&createEIPParams)
-		if err != nil {
-			return fmt.Errorf("Allocate EIP failed:%s", err)
-		}
-		log.Debug(resp)
+// keptDiskName get the name of the nth data disk kept after the machine is
+// removed
+func keptDiskName(machineName string, n int) string {
+	return fmt.Sprintf("%s-data-%d", machineName, n+1)
+}
 
-		if len(*resp.EIPSet) == 0 {
-			return fmt.Errorf("EIP is empty")
-		}
-		eipId := (*resp.EIPSet)[0].EIPId
-		if len(*(*resp.EIPSet)[0].EIPAddr) == 0 {
-			return fmt.Errorf("IP Address is empty")
-		}
-		d.IPAddress = (*(*resp.EIPSet)[0].EIPAddr)[0].IP
+// attachUDisks attach the existing udisks to uhost
+func (d *Driver) attachUDisks(ctx context.Context) error {
+	if len(d.UDiskIds) == 0 {
+		return nil
+	}
 
-		bindHostParams := unet.BindEIPParams{
-			Region:       d.Region,
-			EIPId:        eipId,
-			ResourceType: "uhost",
-			ResourceId:   d.UhostID,
-		}
+	zone, err := d.getZone(ctx)
+	if err != nil {
+		return err
+	}
 
-		bindEIPResp, err := d.getUNetService().BindEIP(&bindHostParams)
-		if err != nil {
-			return fmt.Errorf("Bind EIP failed:%s", err)
+	for _, diskId := range d.UDiskIds {
+		attachUDiskParams := udisk.AttachUDiskParams{
+			Region:  d.Region,
+			Zone:    zone,
+			UHostId: d.UhostID,
+			UDiskId: diskId,
 		}
-		log.Debug(bindEIPResp)
-	} else {
-		hostDetails, err := d.getHostDescription()
-		if err != nil {
-			return fmt.Errorf("get host detail failed: %s", err)
+
+		log.Debugf("attach udisk(%s) to uhost(%s)", diskId, d.UhostID)
+		if _, err := d.call(ctx, "AttachUDisk", &attachUDiskParams, func(ctx context.Context) (interface{}, error) {
+			return d.getUDiskService(ctx).AttachUDisk(&attachUDiskParams)
+		}); err != nil {
+			return fmt.Errorf("attach udisk %s failed:%w", diskId, err)
 		}
-		d.IPAddress = hostDetails.publicIPAddress
-		d.PrivateIPAddress = hostDetails.privateIPAddress
 	}
 
 	return nil
 }
 
-func (d *Driver) getSecurityGroup(name string) (int, error) {
-	log.Debugf("get security group for group:%s", name)
-	describeSecurityGroupsParams := unet.DescribeSecurityGroupParams{
+// detachUDisks detach the attached udisks from uhost, the udisks are kept
+func (d *Driver) detachUDisks(ctx context.Context) error {
+	if len(d.UDiskIds) == 0 {
+		return nil
+	}
+
+	zone, err := d.getZone(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, diskId := range d.UDiskIds {
+		if err := d.detachUDisk(ctx, zone, diskId); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// detachUDisk detach the udisk from uhost
+func (d *Driver) detachUDisk(ctx context.Context, zone, diskId string) error {
+	detachUDiskParams := udisk.DetachUDiskParams{
+		Region:  d.Region,
+		Zone:    zone,
+		UHostId: d.UhostID,
+		UDiskId: diskId,
+	}
+
+	log.Debugf("detach udisk(%s) from uhost(%s)", diskId, d.UhostID)
+	if _, err := d.call(ctx, "DetachUDisk", &detachUDiskParams, func(ctx context.Context) (interface{}, error) {
+		return d.getUDiskService(ctx).DetachUDisk(&detachUDiskParams)
+	}); err != nil {
+		return fmt.Errorf("detach udisk %s failed:%w", diskId, err)
+	}
+
+	return nil
+}
+
+// renameUDisk set the name of udisk
+func (d *Driver) renameUDisk(ctx context.Context, zone, diskId, name string) error {
+	renameUDiskParams := udisk.RenameUDiskParams{
+		Region:    d.Region,
+		Zone:      zone,
+		UDiskId:   diskId,
+		UDiskName: name,
+	}
+
+	log.Debugf("rename udisk(%s) to %s", diskId, name)
+	if _, err := d.call(ctx, "RenameUDisk", &renameUDiskParams, func(ctx context.Context) (interface{}, error) {
+		return d.getUDiskService(ctx).RenameUDisk(&renameUDiskParams)
+	}); err != nil {
+		return fmt.Errorf("rename udisk %s failed:%w", diskId, err)
+	}
+
+	return nil
+}
+
+// udiskExists check whether the udisk is still in the region
+func (d *Driver) udiskExists(ctx context.Context, diskId string) (bool, error) {
+	describeUDiskParams := udisk.DescribeUDiskParams{
+		Region:  d.Region,
+		Zone:    d.Zone,
+		UDiskId: diskId,
+	}
+
+	r, err := d.call(ctx, "DescribeUDisk", &describeUDiskParams, func(ctx context.Context) (interface{}, error) {
+		return d.getUDiskService(ctx).DescribeUDisk(&describeUDiskParams)
+	})
+	if err != nil {
+		return false, fmt.Errorf("describe udisk %s failed:%w", diskId, err)
+	}
+	resp := r.(*udisk.DescribeUDiskResponse)
+
+	return len(resp.DataSet) > 0, nil
+}
+
+// deleteUDisk delete the detached udisk
+func (d *Driver) deleteUDisk(ctx context.Context, diskId string) error {
+	deleteUDiskParams := udisk.DeleteUDiskParams{
+		Region:  d.Region,
+		Zone:    d.Zone,
+		UDiskId: diskId,
+	}
+
+	log.Debugf("delete udisk(%s)", diskId)
+	_, err := d.call(ctx, "DeleteUDisk", &deleteUDiskParams, func(ctx context.Context) (interface{}, error) {
+		return d.getUDiskService(ctx).DeleteUDisk(&deleteUDiskParams)
+	})
+
+	return err
+}
+
+// ensureVPC create a docker-machine VPC and subnet if there is no usable one,
+// the subnet is created in the existing VPC only if its CIDR blocks have room
+// for the subnet
+// in the region, the created VPC and subnet are removed with the uhost
+func (d *Driver) ensureVPC(ctx context.Context) error {
+	if d.VPCId != "" {
+		return nil
+	}
+
+	describeVPCParams := vpc.DescribeVPCParams{Region: d.Region}
+	r, err := d.call(ctx, "DescribeVPC", &describeVPCParams, func(ctx context.Context) (interface{}, error) {
+		return d.getVPCService(ctx).DescribeVPC(&describeVPCParams)
+	})
+	if err != nil {
+		return fmt.Errorf("describe VPC failed:%w", err)
+	}
+	describeVPCResp := r.(*vpc.DescribeVPCResponse)
+
+	vpcId := ""
+	for _, v := range describeVPCResp.DataSet {
+		describeSubnetParams := vpc.DescribeSubnetParams{
+			Region: d.Region,
+			VPCId:  v.VPCId,
+		}
+		r, err := d.call(ctx, "DescribeSubnet", &describeSubnetParams, func(ctx context.Context) (interface{}, error) {
+			return d.getVPCService(ctx).DescribeSubnet(&describeSubnetParams)
+		})
+		if err != nil {
+			return fmt.Errorf("describe subnet failed:%w", err)
+		}
+		describeSubnetResp := r.(*vpc.DescribeSubnetResponse)
+		if len(describeSubnetResp.DataSet) > 0 {
+			log.Debugf("usable VPC(%s) is found", v.VPCId)
+			return nil
+		}
+		// the subnet can not overlap the others since the VPC has none
+		if vpcId == "" && subnetInNetworks(v.Network, defaultSubnet, defaultSubnetNetmask) {
+			vpcId = v.VPCId
+		}
+	}
+
+	if vpcId == "" {
+		log.Infof("VPC for subnet %s/%d is not found, create a new one", defaultSubnet, defaultSubnetNetmask)
+		createVPCParams := vpc.CreateVPCParams{
+			Region:  d.Region,
+			Name:    "docker-machine",
+			Network: []string{defaultVPCNetwork},
+			Tag:     d.Tag,
+		}
+		r, err := d.call(ctx, "CreateVPC", &createVPCParams, func(ctx context.Context) (interface{}, error) {
+			return d.getVPCService(ctx).CreateVPC(&createVPCParams)
+		})
+		if err != nil {
+			return fmt.Errorf("create VPC failed:%w", err)
+		}
+		resp := r.(*vpc.CreateVPCResponse)
+		vpcId = resp.VPCId
+		d.VPCCreated = true
+	}
+	d.VPCId = vpcId
+
+	log.Infof("subnet is not found, create a new one")
+	createSubnetParams := vpc.CreateSubnetParams{
+		Region:     d.Region,
+		VPCId:      d.VPCId,
+		Subnet:     defaultSubnet,
+		Netmask:    defaultSubnetNetmask,
+		SubnetName: "docker-machine",
+		Tag:        d.Tag,
+	}
+	r, err = d.call(ctx, "CreateSubnet", &createSubnetParams, func(ctx context.Context) (interface{}, error) {
+		return d.getVPCService(ctx).CreateSubnet(&createSubnetParams)
+	})
+	if err != nil {
+		return fmt.Errorf("create subnet failed:%w", err)
+	}
+	resp := r.(*vpc.CreateSubnetResponse)
+	d.SubnetId = resp.SubnetId
+	d.SubnetCreated = true
+
+	return nil
+}
+
+// deleteVPC delete the VPC and subnet created by driver
+func (d *Driver) deleteVPC(ctx context.Context) error {
+	if d.SubnetCreated {
+		log.Debugf("delete subnet(%s)", d.SubnetId)
+		deleteSubnetParams := vpc.DeleteSubnetParams{
+			Region:   d.Region,
+			SubnetId: d.SubnetId,
+		}
+		if _, err := d.call(ctx, "DeleteSubnet", &deleteSubnetParams, func(ctx context.Context) (interface{}, error) {
+			return d.getVPCService(ctx).DeleteSubnet(&deleteSubnetParams)
+		}); err != nil {
+			return fmt.Errorf("delete subnet %s failed:%w", d.SubnetId, err)
+		}
+	}
+
+	if d.VPCCreated {
+		log.Debugf("delete VPC(%s)", d.VPCId)
+		deleteVPCParams := vpc.DeleteVPCParams{
+			Region: d.Region,
+			VPCId:  d.VPCId,
+		}
+		if _, err := d.call(ctx, "DeleteVPC", &deleteVPCParams, func(ctx context.Context) (interface{}, error) {
+			return d.getVPCService(ctx).DeleteVPC(&deleteVPCParams)
+		}); err != nil {
+			return fmt.Errorf("delete VPC %s failed:%w", d.VPCId, err)
+		}
+	}
+
+	return nil
+}
+
+// createSnapshot create a snapshot of the disk
+func (d *Driver) createSnapshot(ctx context.Context, diskId, name string) (string, error) {
+	zone, err := d.getZone(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	createSnapshotParams := udisk.CreateUDiskSnapshotParams{
+		Region:  d.Region,
+		Zone:    zone,
+		UDiskId: diskId,
+		Name:    name,
+		Comment: fmt.Sprintf("created by docker-machine from %s", d.MachineName),
+	}
+
+	r, err := d.call(ctx, "CreateUDiskSnapshot", &createSnapshotParams, func(ctx context.Context) (interface{}, error) {
+		return d.getUDiskService(ctx).CreateUDiskSnapshot(&createSnapshotParams)
+	})
+	if err != nil {
+		return "", err
+	}
+	resp := r.(*udisk.CreateUDiskSnapshotResponse)
+
+	if len(resp.SnapshotId) == 0 {
+		return "", fmt.Errorf("SnapshotId is empty")
+	}
+
+	return resp.SnapshotId[0], nil
+}
+
+// deleteSnapshots delete the snapshots of a failed Snapshot, the snapshots
+// which can not be deleted are logged
+func (d *Driver) deleteSnapshots(ctx context.Context, snapshots map[string]string) {
+	zone, err := d.getZone(ctx)
+	if err != nil {
+		log.Warnf("Unable to delete the snapshots, please remove them manually: %v", snapshots)
+		return
+	}
+
+	for diskId, snapshotId := range snapshots {
+		deleteSnapshotParams := udisk.DeleteUDiskSnapshotParams{
+			Region:     d.Region,
+			Zone:       zone,
+			SnapshotId: snapshotId,
+		}
+		log.Debugf("delete snapshot(%s) of disk %s", snapshotId, diskId)
+		if _, err := d.call(ctx, "DeleteUDiskSnapshot", &deleteSnapshotParams, func(ctx context.Context) (interface{}, error) {
+			return d.getUDiskService(ctx).DeleteUDiskSnapshot(&deleteSnapshotParams)
+		}); err != nil {
+			log.Warnf("Unable to delete the snapshot %s, please remove it manually: %s", snapshotId, err)
+		}
+	}
+}
+
+// restoreSnapshot restore the disk from the snapshot
+func (d *Driver) restoreSnapshot(ctx context.Context, diskId, snapshotId string) error {
+	zone, err := d.getZone(ctx)
+	if err != nil {
+		return err
+	}
+
+	restoreParams := udisk.RestoreUDiskParams{
+		Region:     d.Region,
+		Zone:       zone,
+		UDiskId:    diskId,
+		SnapshotId: snapshotId,
+	}
+
+	_, err = d.call(ctx, "RestoreUDisk", &restoreParams, func(ctx context.Context) (interface{}, error) {
+		return d.getUDiskService(ctx).RestoreUDisk(&restoreParams)
+	})
+
+	return err
+}
+
+// createUNet create network for uhost
+func (d *Driver) createUNet(ctx context.Context) error {
+	if err := d.configureIPAddress(ctx); err != nil {
+		return fmt.Errorf("configure IPAddress error:%w", err)
+	}
+
+	if err := d.configureSecurityGroup(ctx); err != nil {
+		return fmt.Errorf("configure security group error:%w", err)
+	}
+
+	if d.IPv6 {
+		if err := d.assignIPv6Address(ctx); err != nil {
+			return fmt.Errorf("assign IPv6 address error:%w", err)
+		}
+	}
+
+	return nil
+}
+
+// preparedUNet is the EIP and security group got by prepareUNet, they are set
+// on the driver by Create after the uhost is running
+type preparedUNet struct {
+	eipId                string
+	ipAddress            string
+	securityGroupId      int
+	securityGroupCreated bool
+}
+
+// prepareUNet allocate the EIP and get or create the security group, they do
+// not depend on the uhost, so it can run while the uhost is booting. The
+// driver is not changed since the uhost state is polled at the same time, the
+// resources got before an error are returned too so rollback can release them.
+func (d *Driver) prepareUNet(ctx context.Context) (preparedUNet, error) {
+	var p preparedUNet
+	if !d.PrivateIPOnly && !d.ExistingEIP && d.EIPId == "" {
+		eipId, ip, err := d.newEIP(ctx)
+		if err != nil {
+			return p, fmt.Errorf("allocate EIP error:%w", err)
+		}
+		p.eipId, p.ipAddress = eipId, ip
+	}
+
+	if d.SecurityGroupId == 0 {
+		groupId, created, err := d.getOrCreateSecurityGroup(ctx)
+		p.securityGroupId, p.securityGroupCreated = groupId, created
+		if err != nil {
+			return p, fmt.Errorf("get or create security group error:%w", err)
+		}
+	}
+
+	return p, nil
+}
+
+// setPreparedUNet set the resources got by prepareUNet on driver
+func (d *Driver) setPreparedUNet(p preparedUNet) {
+	if p.eipId != "" {
+		d.EIPId, d.IPAddress = p.eipId, p.ipAddress
+	}
+	if p.securityGroupId != 0 {
+		d.SecurityGroupId = p.securityGroupId
+	}
+	if p.securityGroupCreated {
+		d.SecurityGroupCreated = true
+	}
+}
+
+// assignIPv6Address assign an IPv6 address to uhost, the VPC of uhost must
+// be IPv6 enabled
+func (d *Driver) assignIPv6Address(ctx context.Context) error {
+	assignIPv6AddressParams := vpc.AssignIPv6AddressParams{
+		Region:       d.Region,
+		ResourceType: "uhost",
+		ResourceId:   d.UhostID,
+	}
+
+	r, err := d.call(ctx, "AssignIPv6Address", &assignIPv6AddressParams, func(ctx context.Context) (interface{}, error) {
+		return d.getVPCService(ctx).AssignIPv6Address(&assignIPv6AddressParams)
+	})
+	if err != nil {
+		return err
+	}
+	resp := r.(*vpc.AssignIPv6AddressResponse)
+
+	if resp.IPv6Address == "" {
+		return fmt.Errorf("IPv6 address is empty")
+	}
+	d.IPv6Address = resp.IPv6Address
+	log.Debugf("IPv6 address(%s) is assigned to uhost(%s)", d.IPv6Address, d.UhostID)
+
+	return nil
+}
+
+// createKeyPair create keypair for ssh to docker-machine, the existing
+// keypair is copied to machine store if SSHPrivateKeyPath is set
+func (d *Driver) createKeyPair() error {
+	log.Debugf("SSH key path:%s", d.GetSSHKeyPath())
+
+	if d.SSHPrivateKeyPath == "" {
+		if err := ssh.GenerateSSHKey(d.GetSSHKeyPath()); err != nil {
+			return err
+		}
+		return nil
+	}
+
+	log.Debugf("Using existing SSH key:%s", d.SSHPrivateKeyPath)
+	if err := mcnutils.CopyFile(d.SSHPrivateKeyPath, d.GetSSHKeyPath()); err != nil {
+		return err
+	}
+	if err := mcnutils.CopyFile(d.SSHPrivateKeyPath+".pub", d.GetSSHKeyPath()+".pub"); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// importKeyPair import the public key of machine into the UCloud KeyPair
+// service, so it can be picked for the rescue logins in the console. The SDK
+// creates the uhost in the Password login mode only, so the key is still
+// installed at boot or uploaded with password. The name has the time of import
+// so it does not collide with a key pair leaked by an earlier create.
+func (d *Driver) importKeyPair(ctx context.Context) error {
+	publicKey, err := ioutil.ReadFile(d.GetSSHKeyPath() + ".pub")
+	if err != nil {
+		return err
+	}
+
+	importKeyPairParams := uhost.ImportUHostKeyPairsParams{
+		Region:        d.Region,
+		KeyPairName:   keyPairName(d.MachineName, time.Now()),
+		PublicKeyBody: strings.TrimSpace(string(publicKey)),
+	}
+
+	r, err := d.call(ctx, "ImportUHostKeyPairs", &importKeyPairParams, func(ctx context.Context) (interface{}, error) {
+		return d.getUHostService(ctx).ImportUHostKeyPairs(&importKeyPairParams)
+	})
+	if err != nil {
+		return err
+	}
+	resp := r.(*uhost.ImportUHostKeyPairsResponse)
+
+	d.KeyPairId = resp.KeyPair.KeyPairId
+	log.Debugf("imported key pair(%s), fingerprint:%s", d.KeyPairId, resp.KeyPair.KeyPairFingerPrint)
+
+	return nil
+}
+
+// deleteKeyPair delete the key pair imported by driver
+func (d *Driver) deleteKeyPair(ctx context.Context) error {
+	if d.KeyPairId == "" {
+		return nil
+	}
+
+	deleteKeyPairParams := uhost.DeleteUHostKeyPairsParams{
+		Region:     d.Region,
+		KeyPairIds: []string{d.KeyPairId},
+	}
+	log.Debugf("delete key pair(%s)", d.KeyPairId)
+	_, err := d.call(ctx, "DeleteUHostKeyPairs", &deleteKeyPairParams, func(ctx context.Context) (interface{}, error) {
+		return d.getUHostService(ctx).DeleteUHostKeyPairs(&deleteKeyPairParams)
+	})
+
+	return err
+}
+
+func (d *Driver) waitForSSHFunc(client commandRunner, command string) func() bool {
+	return func() bool {
+		_, err := client.Output(command)
+		if err == nil {
+			return true
+		}
+		return false
+	}
+}
+
+// disablePasswordLoginCommand disable the password authentication of sshd
+// and lock the bootstrap password of root and user, the drop-in config is
+// written first since it overrides sshd_config on Ubuntu
+func disablePasswordLoginCommand(user string) string {
+	return "if [ -d /etc/ssh/sshd_config.d ]; then echo 'PasswordAuthentication no' > /etc/ssh/sshd_config.d/00-docker-machine.conf; fi; " +
+		"sed -i -e '/^#\\?PasswordAuthentication /d' -e '$a PasswordAuthentication no' /etc/ssh/sshd_config; " +
+		fmt.Sprintf("passwd -l root; passwd -l %s; ", user) +
+		"systemctl restart sshd || service sshd restart || service ssh restart"
+}
+
+// bootCommands get the commands run by cloud-init at boot, the public key is
+// installed at boot in key pair login mode
+func (d *Driver) bootCommands() ([]string, error) {
+	var commands []string
+	if d.KeyPairLogin {
+		publicKey, err := ioutil.ReadFile(d.GetSSHKeyPath() + ".pub")
+		if err != nil {
+			return nil, err
+		}
+		commands = append(commands, authorizedKeysCommand(d.GetSSHUsername(), string(publicKey)))
+		if d.DisablePasswordLogin {
+			commands = append(commands, disablePasswordLoginCommand(bootstrapUser(d.OsName)))
+		}
+	}
+
+	if d.ConfigureSSHPort {
+		port, _ := d.BaseDriver.GetSSHPort()
+		commands = append(commands, sshPortCommand(port))
+	}
+
+	if d.UMonAgentURL != "" {
+		commands = append(commands, umonAgentCommand(d.UMonAgentURL))
+	}
+
+	return commands, nil
+}
+
+// uploadKeyPair upload the public key to docker-machine
+func (d *Driver) uploadKeyPair() error {
+
+	ipAddr, err := d.GetSSHHostname()
+	if err != nil {
+		return err
+	}
+
+	port, err := d.GetSSHPort()
+	if err != nil {
+		return err
+	}
+
+	// the key may be installed already, like when the host is adopted
+	if keyClient, ok := d.keyClient(ipAddr, port); ok {
+		log.Infof("The public key is installed already, skip uploading it with password")
+		return d.disablePasswordLogin(keyClient, d.GetSSHUsername())
+	}
+
+	// the password is set for the bootstrap user of image, the non-root user
+	// is created in the bootstrap session
+	user := bootstrapUser(d.OsName)
+	sshClient := d.newBootstrapClient(user, ipAddr, port)
+	waitSSH := d.waitForSSHFunc(sshClient, "exit 0")
+	if err := d.waitFor(func() bool { return waitSSH() || sshClient.rejected() != nil }, 3*time.Minute); err != nil {
+		return fmt.Errorf("wait for SSH failed:%w", err)
+	}
+	if err := sshClient.rejected(); err != nil {
+		return err
+	}
+
+	publicKey, err := ioutil.ReadFile(d.GetSSHKeyPath() + ".pub")
+	if err != nil {
+		return err
+	}
+
+	if err := retrySSH(d.sshRetries(), d.sshRetryInterval(), func() error {
+		err := sshClient.installKey(d.GetSSHUsername(), string(publicKey))
+		if err != nil {
+			log.Debugf("Upload public key err: %v", err)
+		}
+		return err
+	}); err != nil {
+		return err
+	}
+
+	return d.disablePasswordLogin(sshClient, user)
+}
+
+// disablePasswordLogin lock the password of the bootstrap user if it is
+// enabled, the command is run by user with client
+func (d *Driver) disablePasswordLogin(client commandRunner, user string) error {
+	if !d.DisablePasswordLogin {
+		return nil
+	}
+
+	command := disablePasswordLoginCommand(bootstrapUser(d.OsName))
+	log.Debugf("Disable password login with command: %s", command)
+	if err := retrySSH(d.sshRetries(), d.sshRetryInterval(), func() error {
+		output, err := client.Output(sudoCommand(user, command))
+		if err != nil {
+			log.Debugf("Disable password login err, output: %v: %s", err, output)
+		}
+		return err
+	}); err != nil {
+		return fmt.Errorf("disable password login failed:%w", err)
+	}
+
+	return nil
+}
+
+// allocateEIP allocate a new EIP for uhost
+func (d *Driver) allocateEIP(ctx context.Context) error {
+	eipId, ip, err := d.newEIP(ctx)
+	if err != nil {
+		return err
+	}
+	d.EIPId = eipId
+	d.IPAddress = ip
+
+	return nil
+}
+
+// newEIP allocate an EIP, the id and IP address of it are returned
+func (d *Driver) newEIP(ctx context.Context) (string, string, error) {
+	payMode, err := eipPayMode(d.EIPChargeMode)
+	if err != nil {
+		return "", "", err
+	}
+
+	createEIPParams := unet.AllocateEIPParams{
+		Region:       d.Region,
+		OperatorName: eipOperator(d.EIPOperator, d.Region),
+		Bandwidth:    d.EIPBandwidth,
+		ChargeType:   "Dynamic",
+		PayMode:      payMode,
+		Quantity:     1,
+		CouponId:     d.CouponId,
+		Tag:          d.Tag,
+	}
+
+	// the bandwidth is provided by the shared bandwidth package
+	if d.ShareBandwidthId != "" {
+		createEIPParams.PayMode = "ShareBandwidth"
+		createEIPParams.ShareBandwidthId = d.ShareBandwidthId
+		createEIPParams.Bandwidth = 0
+	}
+
+	r, err := d.call(ctx, "AllocateEIP", &createEIPParams, func(ctx context.Context) (interface{}, error) {
+		return d.getUNetService(ctx).AllocateEIP(&createEIPParams)
+	})
+	if err != nil {
+		return "", "", fmt.Errorf("Allocate EIP failed:%w", err)
+	}
+	resp := r.(*unet.AllocateEIPResponse)
+
+	if len(*resp.EIPSet) == 0 {
+		return "", "", fmt.Errorf("EIP is empty")
+	}
+	if len(*(*resp.EIPSet)[0].EIPAddr) == 0 {
+		return "", "", fmt.Errorf("IP Address is empty")
+	}
+
+	return (*resp.EIPSet)[0].EIPId, (*(*resp.EIPSet)[0].EIPAddr)[0].IP, nil
+}
+
+// modifyEIPBandwidth change the bandwidth(Mbps) of the EIP
+func (d *Driver) modifyEIPBandwidth(ctx context.Context, bandwidth int) error {
+	modifyParams := unet.ModifyEIPBandwidthParams{
+		Region:    d.Region,
+		EIPId:     d.EIPId,
+		Bandwidth: bandwidth,
+	}
+
+	_, err := d.call(ctx, "ModifyEIPBandwidth", &modifyParams, func(ctx context.Context) (interface{}, error) {
+		return d.getUNetService(ctx).ModifyEIPBandwidth(&modifyParams)
+	})
+	if err != nil {
+		return fmt.Errorf("Modify EIP bandwidth failed:%w", err)
+	}
+
+	return nil
+}
+
+// releaseEIP unbind the EIP from uhost and release it
+func (d *Driver) releaseEIP(ctx context.Context) error {
+	if d.UhostID != "" {
+		unbindEIPParams := unet.UnBindEIPParams{
+			Region:       d.Region,
+			EIPId:        d.EIPId,
+			ResourceType: "uhost",
+			ResourceId:   d.UhostID,
+		}
+		log.Debugf("unbind EIP(%s) from uhost(%s)", d.EIPId, d.UhostID)
+		if _, err := d.call(ctx, "UnBindEIP", &unbindEIPParams, func(ctx context.Context) (interface{}, error) {
+			return d.getUNetService(ctx).UnBindEIP(&unbindEIPParams)
+		}); err != nil {
+			log.Debugf("unbind EIP failed:%s", err)
+		}
+	}
+
+	releaseEIPParams := unet.ReleaseEIPParams{
+		Region: d.Region,
+		EIPId:  d.EIPId,
+	}
+	log.Debugf("release EIP(%s)", d.EIPId)
+	_, err := d.call(ctx, "ReleaseEIP", &releaseEIPParams, func(ctx context.Context) (interface{}, error) {
+		return d.getUNetService(ctx).ReleaseEIP(&releaseEIPParams)
+	})
+
+	return err
+}
+
+// getEIPAddress get the IP address of an existing EIP
+func (d *Driver) getEIPAddress(ctx context.Context, eipId string) (string, error) {
+	describeEIPParams := unet.DescribeEIPParams{
+		Region: d.Region,
+		EIPIds: []string{eipId},
+	}
+
+	r, err := d.call(ctx, "DescribeEIP", &describeEIPParams, func(ctx context.Context) (interface{}, error) {
+		return d.getUNetService(ctx).DescribeEIP(&describeEIPParams)
+	})
+	if err != nil {
+		return "", fmt.Errorf("Describe EIP failed:%w", err)
+	}
+	resp := r.(*unet.DescribeEIPResponse)
+
+	if len(resp.EIPSet) == 0 {
+		return "", fmt.Errorf("EIP:%s is not exist", eipId)
+	}
+	if resp.EIPSet[0].EIPAddr == nil || len(*resp.EIPSet[0].EIPAddr) == 0 {
+		return "", fmt.Errorf("IP Address is empty")
+	}
+
+	return (*resp.EIPSet[0].EIPAddr)[0].IP, nil
+}
+
+// eipExists check whether the EIP is still allocated
+func (d *Driver) eipExists(ctx context.Context, eipId string) (bool, error) {
+	describeEIPParams := unet.DescribeEIPParams{
 		Region: d.Region,
+		EIPIds: []string{eipId},
+	}
+
+	r, err := d.call(ctx, "DescribeEIP", &describeEIPParams, func(ctx context.Context) (interface{}, error) {
+		return d.getUNetService(ctx).DescribeEIP(&describeEIPParams)
+	})
+	if err != nil {
+		return false, fmt.Errorf("Describe EIP failed:%w", err)
+	}
+	resp := r.(*unet.DescribeEIPResponse)
+
+	return len(resp.EIPSet) > 0, nil
+}
+
+func (d *Driver) configureIPAddress(ctx context.Context) error {
+
+	// create an EIP or use the existing one, and bind it to host
+	if !d.PrivateIPOnly {
+		if d.ExistingEIP {
+			ip, err := d.getEIPAddress(ctx, d.EIPId)
+			if err != nil {
+				return err
+			}
+			d.IPAddress = ip
+		} else if d.EIPId == "" {
+			if err := d.allocateEIP(ctx); err != nil {
+				return err
+			}
+		}
+
+		bindHostParams := unet.BindEIPParams{
+			Region:       d.Region,
+			EIPId:        d.EIPId,
+			ResourceType: "uhost",
+			ResourceId:   d.UhostID,
+		}
+
+		r, err := d.call(ctx, "BindEIP", &bindHostParams, func(ctx context.Context) (interface{}, error) {
+			return d.getUNetService(ctx).BindEIP(&bindHostParams)
+		})
+		if err != nil {
+			return fmt.Errorf("Bind EIP failed:%w", err)
+		}
+		bindEIPResp := r.(*unet.BindEIPResponse)
+		log.Debug(bindEIPResp)
+	} else {
+		hostDetails, err := d.api().getHostDescription(ctx)
+		if err != nil {
+			return fmt.Errorf("get host detail failed: %w", err)
+		}
+		d.IPAddress = hostDetails.publicIPAddress
+		d.PrivateIPAddress = hostDetails.privateIPAddress
 	}
-	describeSecurityGroupsResp, err := d.getUNetService().DescribeSecurityGroup(&describeSecurityGroupsParams)
+
+	return nil
+}
+
+func (d *Driver) getSecurityGroup(ctx context.Context, name string) (int, error) {
+	groupId, err := d.findSecurityGroup(ctx, name)
 	if err != nil {
-		return 0, fmt.Errorf("get security groups failed:%s", err)
+		return 0, err
+	}
+	if groupId == 0 {
+		return 0, fmt.Errorf("group:%s is not exist", name)
 	}
 
-	if len(describeSecurityGroupsResp.DataSet) == 0 {
-		return 0, fmt.Errorf("security groups is empty")
+	return groupId, nil
+}
+
+// findSecurityGroup get the id of the security group by name, it is 0 if the
+// group does not exist
+func (d *Driver) findSecurityGroup(ctx context.Context, name string) (int, error) {
+	log.Debugf("get security group for group:%s", name)
+	describeSecurityGroupsParams := unet.DescribeSecurityGroupParams{
+		Region: d.Region,
+	}
+	r, err := d.call(ctx, "DescribeSecurityGroup", &describeSecurityGroupsParams, func(ctx context.Context) (interface{}, error) {
+		return d.getUNetService(ctx).DescribeSecurityGroup(&describeSecurityGroupsParams)
+	})
+	if err != nil {
+		return 0, fmt.Errorf("get security groups failed:%w", err)
 	}
+	describeSecurityGroupsResp := r.(*unet.DescribeSecurityGroupResponse)
 
 	for _, groups := range describeSecurityGroupsResp.DataSet {
 		log.Debugf("name:%s, group id:%d", groups.GroupName, groups.GroupId)
@@ -362,12 +1732,12 @@ func (d *Driver) getSecurityGroup(name string) (int, error) {
 		}
 	}
 
-	return 0, fmt.Errorf("group:%s is not exist", name)
+	return 0, nil
 }
 
-func (d *Driver) securityGroupAvailableFunc(name string) func() bool {
+func (d *Driver) securityGroupAvailableFunc(ctx context.Context, name string) func() bool {
 	return func() bool {
-		_, err := d.getSecurityGroup(name)
+		_, err := d.getSecurityGroup(ctx, name)
 		if err == nil {
 			return true
 		}
@@ -375,40 +1745,148 @@ func (d *Driver) securityGroupAvailableFunc(name string) func() bool {
 	}
 }
 
-func (d *Driver) configureSecurityGroup() error {
-	var groupId int
-	groupId, err := d.getSecurityGroup(d.SecurityGroupName)
+// securityGroupRules get the rules of the security group created by driver,
+// the rules of open ports are appended to the custom or default rules
+func (d *Driver) securityGroupRules() []string {
+	rules := append([]string{}, d.SecurityGroupRules...)
+	if len(rules) == 0 {
+		rules = d.defaultSecurityGroupRules()
+	}
+
+	for _, port := range d.OpenPorts {
+		// the ports are validated in SetConfigFromFlags
+		if rule, err := openPortRule(port); err == nil {
+			rules = append(rules, rule)
+		}
+	}
+
+	return rules
+}
+
+// defaultSecurityGroupRules get the rules of the security group created by
+// driver, ports used by swarm are opened if swarm is enabled
+func (d *Driver) defaultSecurityGroupRules() []string {
+	sshPort, _ := d.BaseDriver.GetSSHPort()
+	rule := []string{fmt.Sprintf("TCP|%d|0.0.0.0/0|ACCEPT|50", sshPort),
+		"TCP|3389|0.0.0.0/0|ACCEPT|50",
+		fmt.Sprintf("TCP|%d|0.0.0.0/0|ACCEPT|50", d.dockerPort()),
+	}
+	if d.SwarmMaster && validPort(swarmPort) {
+		swarmRule := fmt.Sprintf("TCP|%d|0.0.0.0/0|ACCEPT|50", swarmPort)
+		rule = append(rule, swarmRule)
+	}
+
+	// cluster management, node communication and overlay network of swarm
+	if d.SwarmMaster || d.SwarmDiscovery != "" {
+		rule = append(rule,
+			"TCP|2377|0.0.0.0/0|ACCEPT|50",
+			"TCP|7946|0.0.0.0/0|ACCEPT|50",
+			"UDP|7946|0.0.0.0/0|ACCEPT|50",
+			"UDP|4789|0.0.0.0/0|ACCEPT|50",
+		)
+	}
+
+	return rule
+}
+
+// getOrCreateSecurityGroup get the security group by name, a new one is
+// created if it is not exist, created reports whether the group is created
+// even if it is not available yet
+func (d *Driver) getOrCreateSecurityGroup(ctx context.Context) (groupId int, created bool, err error) {
+	groupId, err = d.getSecurityGroup(ctx, d.SecurityGroupName)
 	if err != nil {
 		log.Debugf("get security group error:%s", err)
 	}
 	log.Debugf("groupId:%d", groupId)
-	if groupId == 0 {
-		log.Infof("security group is not found, create a new one")
-		rule := []string{"TCP|22|0.0.0.0/0|ACCEPT|50",
-			"TCP|3389|0.0.0.0/0|ACCEPT|50",
-			"TCP|2376|0.0.0.0/0|ACCEPT|50",
+	if groupId != 0 {
+		if len(d.OpenPorts) > 0 {
+			log.Warnf("The ports %s are not opened in the existing security group %s", strings.Join(d.OpenPorts, ","), d.SecurityGroupName)
 		}
-		if d.SwarmMaster && validPort(swarmPort) {
-			swarmRule := fmt.Sprintf("TCP|%d|0.0.0.0/0|ACCEPT|50", swarmPort)
-			rule = append(rule, swarmRule)
+		return groupId, false, nil
+	}
+
+	log.Infof("security group is not found, create a new one")
+	return d.createSecurityGroup(ctx, d.SecurityGroupName, "docker machine to open 2379 and 22 port of tcp", d.securityGroupRules())
+}
+
+// createSecurityGroup create the security group with the rules and wait for
+// it to become available, created reports whether the group is created even
+// if it is not available yet
+func (d *Driver) createSecurityGroup(ctx context.Context, name, description string, rules []string) (groupId int, created bool, err error) {
+	log.Debugf("security group rules:%v", rules)
+
+	securityGroupParams := unet.CreateSecurityGroupParams{
+		Region:      d.Region,
+		GroupName:   name,
+		Description: description,
+		Rule:        rules,
+	}
+	if _, err := d.create(ctx, "CreateSecurityGroup", &securityGroupParams, func(ctx context.Context) (interface{}, error) {
+		return d.getUNetService(ctx).CreateSecurityGroup(&securityGroupParams)
+	}, func(ctx context.Context) (interface{}, error) {
+		groupId, err := d.findSecurityGroup(ctx, name)
+		if err != nil || groupId == 0 {
+			return nil, err
 		}
+		return &unet.CreateSecurityGroupResponse{}, nil
+	}); err != nil {
+		return 0, false, fmt.Errorf("create security group failed:%w", err)
+	}
 
-		securityGroupParams := unet.CreateSecurityGroupParams{
-			Region:      d.Region,
-			GroupName:   "docker-machine",
-			Description: "docker machine to open 2379 and 22 port of tcp",
-			Rule:        rule,
+	log.Debug("waiting for security group to become avaliable")
+	if err := d.waitFor(d.securityGroupAvailableFunc(ctx, name), 3*time.Minute); err != nil {
+		return 0, true, err
+	}
+
+	groupId, err = d.getSecurityGroup(ctx, name)
+	return groupId, true, err
+}
+
+// deleteSecurityGroup delete the security group created by driver
+func (d *Driver) deleteSecurityGroup(ctx context.Context, groupId int) error {
+	deleteSecurityGroupParams := unet.DeleteSecurityGroupParams{
+		Region:  d.Region,
+		GroupId: groupId,
+	}
+	log.Debugf("delete security group(%d)", groupId)
+	_, err := d.call(ctx, "DeleteSecurityGroup", &deleteSecurityGroupParams, func(ctx context.Context) (interface{}, error) {
+		return d.getUNetService(ctx).DeleteSecurityGroup(&deleteSecurityGroupParams)
+	})
+
+	return err
+}
+
+// securityGroupExists check whether the security group is not deleted
+func (d *Driver) securityGroupExists(ctx context.Context, groupId int) (bool, error) {
+	describeSecurityGroupParams := unet.DescribeSecurityGroupParams{
+		Region:  d.Region,
+		GroupId: groupId,
+	}
+
+	r, err := d.call(ctx, "DescribeSecurityGroup", &describeSecurityGroupParams, func(ctx context.Context) (interface{}, error) {
+		return d.getUNetService(ctx).DescribeSecurityGroup(&describeSecurityGroupParams)
+	})
+	if err != nil {
+		return false, fmt.Errorf("describe security group failed:%w", err)
+	}
+	resp := r.(*unet.DescribeSecurityGroupResponse)
+
+	return len(resp.DataSet) > 0, nil
+}
+
+func (d *Driver) configureSecurityGroup(ctx context.Context) error {
+	// use the existing security group if it is specified
+	groupId := d.SecurityGroupId
+	if groupId == 0 {
+		var created bool
+		var err error
+		groupId, created, err = d.getOrCreateSecurityGroup(ctx)
+		if created {
+			d.SecurityGroupCreated = true
 		}
-		_, err := d.getUNetService().CreateSecurityGroup(&securityGroupParams)
 		if err != nil {
-			return fmt.Errorf("create security group failed:%s", err)
-		}
-
-		log.Debug("waiting for security group to become avaliable")
-		if err := mcnutils.WaitFor(d.securityGroupAvailableFunc(d.SecurityGroupName)); err != nil {
 			return err
 		}
-		groupId, err = d.getSecurityGroup(d.SecurityGroupName)
 	}
 	d.SecurityGroupId = groupId
 
@@ -419,9 +1897,452 @@ func (d *Driver) configureSecurityGroup() error {
 		ResourceId:   d.UhostID,
 	}
 	log.Debugf("grant security group(%d) to uhost(%s)", groupId, d.UhostID)
-	_, err = d.getUNetService().GrantSecurityGroup(&grantSecurityGroupParams)
+	_, err := d.call(ctx, "GrantSecurityGroup", &grantSecurityGroupParams, func(ctx context.Context) (interface{}, error) {
+		return d.getUNetService(ctx).GrantSecurityGroup(&grantSecurityGroupParams)
+	})
+	if err != nil {
+		return fmt.Errorf("grant security group failed:%w", err)
+	}
+
+	return nil
+}
+
+// registerULB add the uhost as backend to all the vservers of the ULB
+func (d *Driver) registerULB(ctx context.Context) error {
+	if d.ULBId == "" {
+		return nil
+	}
+
+	describeULBParams := ulb.DescribeULBParams{
+		Region: d.Region,
+		ULBId:  d.ULBId,
+	}
+	r, err := d.call(ctx, "DescribeULB", &describeULBParams, func(ctx context.Context) (interface{}, error) {
+		return d.getULBService(ctx).DescribeULB(&describeULBParams)
+	})
+	if err != nil {
+		return fmt.Errorf("describe ULB failed:%w", err)
+	}
+	resp := r.(*ulb.DescribeULBResponse)
+
+	if len(resp.DataSet) == 0 {
+		return fmt.Errorf("ULB:%s is not exist", d.ULBId)
+	}
+	if len(resp.DataSet[0].VServerSet) == 0 {
+		return fmt.Errorf("ULB:%s has no vserver", d.ULBId)
+	}
+
+	for _, vserver := range resp.DataSet[0].VServerSet {
+		allocateBackendParams := ulb.AllocateBackendParams{
+			Region:       d.Region,
+			ULBId:        d.ULBId,
+			VServerId:    vserver.VServerId,
+			ResourceType: "UHost",
+			ResourceId:   d.UhostID,
+			Port:         d.ULBBackendPort,
+		}
+		log.Debugf("add uhost(%s) to vserver(%s) of ULB(%s)", d.UhostID, vserver.VServerId, d.ULBId)
+		r, err := d.call(ctx, "AllocateBackend", &allocateBackendParams, func(ctx context.Context) (interface{}, error) {
+			return d.getULBService(ctx).AllocateBackend(&allocateBackendParams)
+		})
+		if err != nil {
+			return fmt.Errorf("allocate backend of vserver %s failed:%w", vserver.VServerId, err)
+		}
+		resp := r.(*ulb.AllocateBackendResponse)
+		d.ULBBackendIds = append(d.ULBBackendIds, resp.BackendId)
+	}
+
+	return nil
+}
+
+// deregisterULB remove the uhost backends from the ULB
+func (d *Driver) deregisterULB(ctx context.Context) error {
+	for len(d.ULBBackendIds) > 0 {
+		backendId := d.ULBBackendIds[0]
+		releaseBackendParams := ulb.ReleaseBackendParams{
+			Region:    d.Region,
+			ULBId:     d.ULBId,
+			BackendId: backendId,
+		}
+		log.Debugf("release backend(%s) of ULB(%s)", backendId, d.ULBId)
+		if _, err := d.call(ctx, "ReleaseBackend", &releaseBackendParams, func(ctx context.Context) (interface{}, error) {
+			return d.getULBService(ctx).ReleaseBackend(&releaseBackendParams)
+		}); err != nil {
+			return fmt.Errorf("release backend %s failed:%w", backendId, err)
+		}
+		d.ULBBackendIds = d.ULBBackendIds[1:]
+	}
+
+	return nil
+}
+
+// bindAlarmTemplate attach the uhost to the existing UMon alarm template
+func (d *Driver) bindAlarmTemplate(ctx context.Context) error {
+	if d.AlarmTemplateId == "" {
+		return nil
+	}
+
+	bindAlarmTemplateParams := umon.BindAlarmTemplateParams{
+		Region:          d.Region,
+		AlarmTemplateId: d.AlarmTemplateId,
+		ResourceType:    "uhost",
+		ResourceId:      []string{d.UhostID},
+	}
+	log.Debugf("bind alarm template(%s) to uhost(%s)", d.AlarmTemplateId, d.UhostID)
+	_, err := d.call(ctx, "BindAlarmTemplate", &bindAlarmTemplateParams, func(ctx context.Context) (interface{}, error) {
+		return d.getUMonService(ctx).BindAlarmTemplate(&bindAlarmTemplateParams)
+	})
+
+	return err
+}
+
+// installDocker install Docker with the install script over SSH
+func (d *Driver) installDocker() error {
+	if err := drivers.WaitForSSH(d); err != nil {
+		return err
+	}
+
+	command := fmt.Sprintf("if ! type docker >/dev/null 2>&1; then %s; fi", dockerInstallCommand(d.DockerInstallURL, d.Region))
+	log.Infof("Installing Docker from %s...", d.DockerInstallURL)
+	output, err := drivers.RunSSHCommandFromDriver(d, command)
+	if err != nil {
+		log.Debugf("Install Docker err, output: %v: %s", err, output)
+		return err
+	}
+
+	return nil
+}
+
+// attachNATGW attach the subnet of uhost to the NAT gateway, a new NAT gateway
+// is created if it is not set, so the private only uhost can access internet
+func (d *Driver) attachNATGW(ctx context.Context) error {
+	if d.NATGWId == "" && !d.CreateNATGW {
+		return nil
+	}
+
+	hostDetails, err := d.api().getHostDescription(ctx)
+	if err != nil {
+		return fmt.Errorf("get host detail failed: %w", err)
+	}
+	if hostDetails.subnetId == "" {
+		return fmt.Errorf("subnet of uhost %s is unknown", d.UhostID)
+	}
+
+	if d.NATGWId == "" {
+		return d.createNATGW(ctx, hostDetails.vpcId, hostDetails.subnetId)
+	}
+
+	describeNATGWParams := vpc.DescribeNATGWParams{
+		Region:   d.Region,
+		NATGWIds: []string{d.NATGWId},
+	}
+	r, err := d.call(ctx, "DescribeNATGW", &describeNATGWParams, func(ctx context.Context) (interface{}, error) {
+		return d.getVPCService(ctx).DescribeNATGW(&describeNATGWParams)
+	})
+	if err != nil {
+		return fmt.Errorf("describe NAT gateway failed:%w", err)
+	}
+	resp := r.(*vpc.DescribeNATGWResponse)
+	if len(resp.DataSet) == 0 {
+		return fmt.Errorf("NAT gateway:%s is not exist", d.NATGWId)
+	}
+
+	subnetIds := []string{hostDetails.subnetId}
+	for _, subnet := range resp.DataSet[0].SubnetSet {
+		if subnet.SubnetworkId == hostDetails.subnetId {
+			log.Debugf("subnet(%s) is attached to NAT gateway(%s) already", hostDetails.subnetId, d.NATGWId)
+			return nil
+		}
+		subnetIds = append(subnetIds, subnet.SubnetworkId)
+	}
+
+	if err := d.updateNATGWSubnet(ctx, subnetIds); err != nil {
+		return err
+	}
+	d.NATGWSubnetId = hostDetails.subnetId
+
+	return nil
+}
+
+// createNATGW create a NAT gateway with a new EIP and its own firewall for the
+// subnet, the firewall of uhost is not used since it opens the Docker ports
+func (d *Driver) createNATGW(ctx context.Context, vpcId, subnetId string) error {
+	groupId, created, err := d.createSecurityGroup(ctx, natgwFirewallName(d.MachineName), "docker machine NAT gateway firewall", natgwFirewallRules)
+	if created {
+		d.NATGWFirewallCreated = true
+		d.NATGWFirewallId = groupId
+	}
+	if err != nil {
+		return fmt.Errorf("create firewall of NAT gateway failed:%w", err)
+	}
+
+	eipId, _, err := d.newEIP(ctx)
+	if err != nil {
+		return fmt.Errorf("allocate EIP of NAT gateway failed:%w", err)
+	}
+
+	createNATGWParams := vpc.CreateNATGWParams{
+		Region:        d.Region,
+		NATGWName:     "docker-machine-" + d.MachineName,
+		EIPIds:        []string{eipId},
+		FirewallId:    strconv.Itoa(groupId),
+		SubnetworkIds: []string{subnetId},
+		VPCId:         vpcId,
+		Tag:           d.Tag,
+		Remark:        defaultRemark,
+	}
+	r, err := d.call(ctx, "CreateNATGW", &createNATGWParams, func(ctx context.Context) (interface{}, error) {
+		return d.getVPCService(ctx).CreateNATGW(&createNATGWParams)
+	})
+	if err != nil {
+		releaseEIPParams := unet.ReleaseEIPParams{
+			Region: d.Region,
+			EIPId:  eipId,
+		}
+		if _, err := d.call(ctx, "ReleaseEIP", &releaseEIPParams, func(ctx context.Context) (interface{}, error) {
+			return d.getUNetService(ctx).ReleaseEIP(&releaseEIPParams)
+		}); err != nil {
+			log.Warnf("Unable to release the EIP(%s) of NAT gateway: %s", eipId, err)
+		}
+		return fmt.Errorf("create NAT gateway failed:%w", err)
+	}
+	resp := r.(*vpc.CreateNATGWResponse)
+
+	d.NATGWId = resp.NATGWId
+	d.NATGWCreated = true
+	log.Infof("NAT gateway %s is created for subnet %s", d.NATGWId, subnetId)
+
+	return nil
+}
+
+// updateNATGWSubnet set the subnets attached to the NAT gateway
+func (d *Driver) updateNATGWSubnet(ctx context.Context, subnetIds []string) error {
+	updateParams := vpc.UpdateNATGWSubnetParams{
+		Region:        d.Region,
+		NATGWId:       d.NATGWId,
+		SubnetworkIds: subnetIds,
+	}
+	if _, err := d.call(ctx, "UpdateNATGWSubnet", &updateParams, func(ctx context.Context) (interface{}, error) {
+		return d.getVPCService(ctx).UpdateNATGWSubnet(&updateParams)
+	}); err != nil {
+		return fmt.Errorf("update subnets of NAT gateway %s failed:%w", d.NATGWId, err)
+	}
+
+	return nil
+}
+
+// detachNATGW delete the NAT gateway created by driver with its EIP and
+// firewall, the subnet attached to the existing NAT gateway is detached only
+// if the subnet is deleted with the uhost, since the other uhosts in it may use
+// the NAT. The existing NAT gateway is never deleted.
+func (d *Driver) detachNATGW(ctx context.Context) error {
+	if d.NATGWCreated {
+		if err := d.deleteNATGW(ctx); err != nil {
+			return err
+		}
+	}
+
+	if d.NATGWFirewallCreated && d.NATGWFirewallId != 0 {
+		if err := d.deleteSecurityGroup(ctx, d.NATGWFirewallId); err != nil {
+			return fmt.Errorf("delete firewall %d of NAT gateway failed:%w", d.NATGWFirewallId, err)
+		}
+	}
+
+	if d.NATGWCreated {
+		return nil
+	}
+
+	if d.NATGWSubnetId == "" || !d.SubnetCreated {
+		return nil
+	}
+
+	describeNATGWParams := vpc.DescribeNATGWParams{
+		Region:   d.Region,
+		NATGWIds: []string{d.NATGWId},
+	}
+	r, err := d.call(ctx, "DescribeNATGW", &describeNATGWParams, func(ctx context.Context) (interface{}, error) {
+		return d.getVPCService(ctx).DescribeNATGW(&describeNATGWParams)
+	})
 	if err != nil {
-		return fmt.Errorf("grant security group failed:%s", err)
+		return fmt.Errorf("describe NAT gateway failed:%w", err)
+	}
+	resp := r.(*vpc.DescribeNATGWResponse)
+	if len(resp.DataSet) == 0 {
+		return nil
+	}
+
+	var subnetIds []string
+	for _, subnet := range resp.DataSet[0].SubnetSet {
+		if subnet.SubnetworkId != d.NATGWSubnetId {
+			subnetIds = append(subnetIds, subnet.SubnetworkId)
+		}
+	}
+
+	// the NAT gateway can not be left without subnet, it is kept attached since
+	// it is not created by driver
+	if len(subnetIds) == 0 {
+		log.Warnf("Subnet %s is the last one of NAT gateway %s and can not be detached, the NAT gateway is kept", d.NATGWSubnetId, d.NATGWId)
+		return nil
+	}
+	log.Debugf("detach subnet(%s) from NAT gateway(%s)", d.NATGWSubnetId, d.NATGWId)
+
+	return d.updateNATGWSubnet(ctx, subnetIds)
+}
+
+// deleteNATGW delete the NAT gateway created by driver and release its EIP
+func (d *Driver) deleteNATGW(ctx context.Context) error {
+	deleteNATGWParams := vpc.DeleteNATGWParams{
+		Region:     d.Region,
+		NATGWId:    d.NATGWId,
+		ReleaseEip: true,
+	}
+	log.Debugf("delete NAT gateway(%s)", d.NATGWId)
+	if _, err := d.call(ctx, "DeleteNATGW", &deleteNATGWParams, func(ctx context.Context) (interface{}, error) {
+		return d.getVPCService(ctx).DeleteNATGW(&deleteNATGWParams)
+	}); err != nil {
+		return fmt.Errorf("delete NAT gateway %s failed:%w", d.NATGWId, err)
+	}
+
+	return nil
+}
+
+// attachSecondaryNIC create a network interface in the secondary subnet and
+// attach it to uhost, the subnet must be in the VPC of uhost
+func (d *Driver) attachSecondaryNIC(ctx context.Context) error {
+	if d.SecondarySubnetId == "" {
+		return nil
+	}
+
+	hostDetails, err := d.api().getHostDescription(ctx)
+	if err != nil {
+		return fmt.Errorf("get host detail failed: %w", err)
+	}
+
+	createParams := vpc.CreateNetworkInterfaceParams{
+		Region:   d.Region,
+		VPCId:    hostDetails.vpcId,
+		SubnetId: d.SecondarySubnetId,
+		Name:     d.MachineName,
+		Remark:   defaultRemark,
+	}
+	r, err := d.call(ctx, "CreateNetworkInterface", &createParams, func(ctx context.Context) (interface{}, error) {
+		return d.getVPCService(ctx).CreateNetworkInterface(&createParams)
+	})
+	if err != nil {
+		return fmt.Errorf("create network interface failed:%w", err)
+	}
+	resp := r.(*vpc.CreateNetworkInterfaceResponse)
+
+	d.NetworkInterfaceId = resp.NetworkInterface.InterfaceId
+	if len(resp.NetworkInterface.PrivateIpSet) > 0 {
+		d.SecondaryIPAddress = resp.NetworkInterface.PrivateIpSet[0]
+	}
+
+	attachParams := vpc.AttachNetworkInterfaceParams{
+		Region:      d.Region,
+		InterfaceId: d.NetworkInterfaceId,
+		InstanceId:  d.UhostID,
+	}
+	log.Debugf("attach network interface(%s) to uhost(%s)", d.NetworkInterfaceId, d.UhostID)
+	if _, err := d.call(ctx, "AttachNetworkInterface", &attachParams, func(ctx context.Context) (interface{}, error) {
+		return d.getVPCService(ctx).AttachNetworkInterface(&attachParams)
+	}); err != nil {
+		return fmt.Errorf("attach network interface failed:%w", err)
+	}
+
+	return nil
+}
+
+// deleteSecondaryNIC delete the network interface created by driver, it is
+// detached after the uhost is terminated
+func (d *Driver) deleteSecondaryNIC(ctx context.Context) error {
+	if d.NetworkInterfaceId == "" {
+		return nil
+	}
+
+	deleteParams := vpc.DeleteNetworkInterfaceParams{
+		Region:      d.Region,
+		InterfaceId: d.NetworkInterfaceId,
+	}
+	log.Debugf("delete network interface(%s)", d.NetworkInterfaceId)
+	_, err := d.call(ctx, "DeleteNetworkInterface", &deleteParams, func(ctx context.Context) (interface{}, error) {
+		return d.getVPCService(ctx).DeleteNetworkInterface(&deleteParams)
+	})
+
+	return err
+}
+
+// allocateSecondaryIPs allocate the secondary private IPs on the primary
+// network interface of uhost
+func (d *Driver) allocateSecondaryIPs(ctx context.Context) error {
+	if d.SecondaryIPCount == 0 {
+		return nil
+	}
+
+	hostDetails, err := d.api().getHostDescription(ctx)
+	if err != nil {
+		return fmt.Errorf("get host detail failed: %w", err)
+	}
+
+	for len(d.SecondaryIPs) < d.SecondaryIPCount {
+		allocateParams := vpc.AllocateSecondaryIpParams{
+			Region:   d.Region,
+			Zone:     hostDetails.zone,
+			Mac:      hostDetails.mac,
+			ObjectId: d.UhostID,
+			SubnetId: hostDetails.subnetId,
+			VPCId:    hostDetails.vpcId,
+		}
+		r, err := d.call(ctx, "AllocateSecondaryIp", &allocateParams, func(ctx context.Context) (interface{}, error) {
+			return d.getVPCService(ctx).AllocateSecondaryIp(&allocateParams)
+		})
+		if err != nil {
+			return fmt.Errorf("allocate secondary IP failed:%w", err)
+		}
+		resp := r.(*vpc.AllocateSecondaryIpResponse)
+
+		log.Debugf("allocated secondary IP %s for uhost(%s)", resp.IpInfo.Ip, d.UhostID)
+		d.SecondaryIPs = append(d.SecondaryIPs, resp.IpInfo.Ip)
+	}
+
+	return nil
+}
+
+// deleteSecondaryIPs release the secondary private IPs of uhost, it must be
+// done before the uhost is terminated
+func (d *Driver) deleteSecondaryIPs(ctx context.Context) error {
+	if len(d.SecondaryIPs) == 0 {
+		return nil
+	}
+
+	hostDetails, err := d.api().getHostDescription(ctx)
+	if err != nil {
+		return fmt.Errorf("get host detail failed: %w", err)
+	}
+
+	var left []string
+	for _, ip := range d.SecondaryIPs {
+		deleteParams := vpc.DeleteSecondaryIpParams{
+			Region:   d.Region,
+			Zone:     hostDetails.zone,
+			Ip:       ip,
+			Mac:      hostDetails.mac,
+			SubnetId: hostDetails.subnetId,
+			VPCId:    hostDetails.vpcId,
+			ObjectId: d.UhostID,
+		}
+		log.Debugf("delete secondary IP %s of uhost(%s)", ip, d.UhostID)
+		if _, err := d.call(ctx, "DeleteSecondaryIp", &deleteParams, func(ctx context.Context) (interface{}, error) {
+			return d.getVPCService(ctx).DeleteSecondaryIp(&deleteParams)
+		}); err != nil {
+			log.Debugf("delete secondary IP failed:%s", err)
+			left = append(left, ip)
+		}
+	}
+
+	d.SecondaryIPs = left
+	if len(left) > 0 {
+		return fmt.Errorf("secondary IPs %s are not deleted", strings.Join(left, ","))
 	}
 
 	return nil
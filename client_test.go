@@ -2,6 +2,7 @@ package ucloud
 
 
 import (
+	"context"
 	"testing"
 )
 
@@ -11,7 +12,7 @@ func TestCreateUNet(t *testing.T) {
 		UhostID: "uhost-ygtk1p",
 	}
 
-	err := d.createUNet()
+	err := d.createUNet(context.Background())
 	if  err != nil {
 		t.Errorf("create UNet failed:%s", err)
 	}
@@ -0,0 +1,88 @@
+package ucloud
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/docker/machine/libmachine/mcnutils"
+)
+
+const (
+	sharedConfigFile     = "config.json"
+	sharedCredentialFile = "credential.json"
+)
+
+// sharedConfig is the config shared with the ucloud CLI, it is loaded from
+// ~/.ucloud when the flags and environment variables are absent
+type sharedConfig struct {
+	PublicKey  string
+	PrivateKey string
+	Region     string
+	ProjectId  string
+}
+
+type cliConfig struct {
+	Profile   string `json:"profile"`
+	ProjectID string `json:"project_id"`
+	Region    string `json:"region"`
+	Active    bool   `json:"active"`
+}
+
+type cliCredential struct {
+	Profile    string `json:"profile"`
+	PublicKey  string `json:"public_key"`
+	PrivateKey string `json:"private_key"`
+}
+
+func defaultSharedConfigDir() string {
+	return filepath.Join(mcnutils.GetHomeDir(), ".ucloud")
+}
+
+// loadSharedConfig load the config of the active profile from the ucloud CLI
+// config dir, an empty config is returned if the config files are not exist
+func loadSharedConfig(dir string) (*sharedConfig, error) {
+	var configs []cliConfig
+	if err := readJSONFile(filepath.Join(dir, sharedConfigFile), &configs); err != nil {
+		return nil, err
+	}
+
+	var credentials []cliCredential
+	if err := readJSONFile(filepath.Join(dir, sharedCredentialFile), &credentials); err != nil {
+		return nil, err
+	}
+
+	profile := "default"
+	cfg := &sharedConfig{}
+	for _, c := range configs {
+		if c.Active {
+			profile = c.Profile
+			cfg.Region = c.Region
+			cfg.ProjectId = c.ProjectID
+			break
+		}
+	}
+
+	for _, c := range credentials {
+		if c.Profile == profile {
+			cfg.PublicKey = c.PublicKey
+			cfg.PrivateKey = c.PrivateKey
+			break
+		}
+	}
+
+	return cfg, nil
+}
+
+func readJSONFile(path string, v interface{}) error {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(data, v)
+}
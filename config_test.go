@@ -0,0 +1,53 @@
+package ucloud
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadSharedConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ucloud-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	config := `[{"profile":"default","project_id":"org-1","region":"cn-bj2","active":false},
+		{"profile":"test","project_id":"org-2","region":"cn-sh2","active":true}]`
+	credential := `[{"profile":"default","public_key":"pub-1","private_key":"pri-1"},
+		{"profile":"test","public_key":"pub-2","private_key":"pri-2"}]`
+	if err := ioutil.WriteFile(filepath.Join(dir, sharedConfigFile), []byte(config), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, sharedCredentialFile), []byte(credential), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := loadSharedConfig(dir)
+	if err != nil {
+		t.Fatalf("load shared config failed:%s", err)
+	}
+
+	expected := sharedConfig{
+		PublicKey:  "pub-2",
+		PrivateKey: "pri-2",
+		Region:     "cn-sh2",
+		ProjectId:  "org-2",
+	}
+	if *cfg != expected {
+		t.Errorf("expected config:%+v, got:%+v", expected, *cfg)
+	}
+}
+
+func TestLoadSharedConfigNotExist(t *testing.T) {
+	cfg, err := loadSharedConfig(filepath.Join(os.TempDir(), "ucloud-config-not-exist"))
+	if err != nil {
+		t.Fatalf("load shared config failed:%s", err)
+	}
+
+	if *cfg != (sharedConfig{}) {
+		t.Errorf("expected empty config, got:%+v", *cfg)
+	}
+}
@@ -0,0 +1,139 @@
+package ucloud
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// passphraseEnv is the passphrase to encrypt the API credentials saved in the
+// machine config, they are saved in plaintext if it is not set
+const passphraseEnv = "UCLOUD_CONFIG_PASSPHRASE"
+
+// encryptedPrefix marks the encrypted values in the machine config
+const encryptedPrefix = "encrypted:"
+
+const saltSize = 16
+
+var errPassphraseRequired = errors.New(passphraseEnv + " is required to decrypt the credentials")
+
+// driverConfig is the Driver without the JSON methods
+type driverConfig Driver
+
+// MarshalJSON encrypt the API credentials with the passphrase in
+// UCLOUD_CONFIG_PASSPHRASE when the machine config is saved
+func (d *Driver) MarshalJSON() ([]byte, error) {
+	passphrase := os.Getenv(passphraseEnv)
+	if passphrase == "" {
+		return json.Marshal((*driverConfig)(d))
+	}
+
+	c := *d
+	for _, secret := range []*string{&c.PublicKey, &c.PrivateKey, &c.SecurityToken} {
+		if *secret == "" || strings.HasPrefix(*secret, encryptedPrefix) {
+			continue
+		}
+		encrypted, err := encryptSecret(*secret, passphrase)
+		if err != nil {
+			return nil, fmt.Errorf("encrypt credentials failed:%w", err)
+		}
+		*secret = encrypted
+	}
+
+	return json.Marshal((*driverConfig)(&c))
+}
+
+// UnmarshalJSON decrypt the API credentials encrypted by MarshalJSON and
+// translate the deprecated region name when the machine config is loaded
+func (d *Driver) UnmarshalJSON(b []byte) error {
+	if err := json.Unmarshal(b, (*driverConfig)(d)); err != nil {
+		return err
+	}
+
+	// the machines created with the deprecated region name
+	d.Region, _ = canonicalRegion(d.Region)
+
+	passphrase := os.Getenv(passphraseEnv)
+	for _, secret := range []*string{&d.PublicKey, &d.PrivateKey, &d.SecurityToken} {
+		if !strings.HasPrefix(*secret, encryptedPrefix) {
+			continue
+		}
+		if passphrase == "" {
+			return errPassphraseRequired
+		}
+		decrypted, err := decryptSecret(*secret, passphrase)
+		if err != nil {
+			return fmt.Errorf("decrypt credentials failed:%w", err)
+		}
+		*secret = decrypted
+	}
+
+	return nil
+}
+
+// secretCipher get the AES-GCM cipher with the key derived from passphrase
+func secretCipher(passphrase string, salt []byte) (cipher.AEAD, error) {
+	key, err := scrypt.Key([]byte(passphrase), salt, 1<<15, 8, 1, 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// encryptSecret encrypt the secret with passphrase, the salt, nonce and
+// ciphertext are encoded with base64
+func encryptSecret(secret, passphrase string) (string, error) {
+	salt := make([]byte, saltSize)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return "", err
+	}
+	aead, err := secretCipher(passphrase, salt)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+
+	sealed := aead.Seal(append(salt, nonce...), nonce, []byte(secret), nil)
+	return encryptedPrefix + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// decryptSecret decrypt the secret encrypted by encryptSecret
+func decryptSecret(value, passphrase string) (string, error) {
+	sealed, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(value, encryptedPrefix))
+	if err != nil {
+		return "", err
+	}
+	if len(sealed) < saltSize {
+		return "", fmt.Errorf("encrypted value is too short")
+	}
+	aead, err := secretCipher(passphrase, sealed[:saltSize])
+	if err != nil {
+		return "", err
+	}
+	sealed = sealed[saltSize:]
+	if len(sealed) < aead.NonceSize() {
+		return "", fmt.Errorf("encrypted value is too short")
+	}
+
+	secret, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], nil)
+	if err != nil {
+		return "", fmt.Errorf("wrong passphrase or corrupted value")
+	}
+	return string(secret), nil
+}
@@ -0,0 +1,60 @@
+package ucloud
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestEncryptCredentials(t *testing.T) {
+	t.Setenv(passphraseEnv, "passphrase")
+
+	d := NewDriver("ucloud-machine", "")
+	d.PublicKey, d.PrivateKey = "public-key", "private-key"
+
+	b, err := json.Marshal(d)
+	if err != nil {
+		t.Fatalf("marshal driver failed:%s", err)
+	}
+	if strings.Contains(string(b), "public-key") || strings.Contains(string(b), "private-key") {
+		t.Errorf("the credentials should be encrypted, got:%s", b)
+	}
+	if !strings.Contains(string(b), `"MachineName":"ucloud-machine"`) {
+		t.Errorf("the other fields should be kept, got:%s", b)
+	}
+	if d.PrivateKey != "private-key" {
+		t.Errorf("the driver should not be changed, got:%s", d.PrivateKey)
+	}
+
+	loaded := &Driver{}
+	if err := json.Unmarshal(b, loaded); err != nil {
+		t.Fatalf("unmarshal driver failed:%s", err)
+	}
+	if loaded.PublicKey != "public-key" || loaded.PrivateKey != "private-key" {
+		t.Errorf("the credentials should be decrypted, got:%s, %s", loaded.PublicKey, loaded.PrivateKey)
+	}
+
+	t.Setenv(passphraseEnv, "wrong")
+	if err := json.Unmarshal(b, &Driver{}); err == nil {
+		t.Errorf("decrypt with the wrong passphrase should fail")
+	}
+
+	t.Setenv(passphraseEnv, "")
+	if err := json.Unmarshal(b, &Driver{}); err != errPassphraseRequired {
+		t.Errorf("expected error:%s, got:%v", errPassphraseRequired, err)
+	}
+}
+
+func TestPlaintextCredentials(t *testing.T) {
+	t.Setenv(passphraseEnv, "")
+
+	d := NewDriver("ucloud-machine", "")
+	d.PrivateKey = "private-key"
+	b, err := json.Marshal(d)
+	if err != nil {
+		t.Fatalf("marshal driver failed:%s", err)
+	}
+	if !strings.Contains(string(b), `"PrivateKey":"private-key"`) {
+		t.Errorf("the credentials should be saved in plaintext without passphrase, got:%s", b)
+	}
+}
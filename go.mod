@@ -0,0 +1,14 @@
+module github.com/ucloud/docker-machine-ucloud
+
+go 1.25.0
+
+// the legacy service/* API of github.com/ucloud/ucloud-sdk-go has no tagged
+// release, pin the commit the driver is built with by
+// go get github.com/ucloud/ucloud-sdk-go@<commit>
+require (
+	github.com/docker/machine v0.16.2+incompatible
+	github.com/pkg/sftp v1.13.11
+	golang.org/x/crypto v0.54.0
+)
+
+require github.com/kr/fs v0.1.0 // indirect
@@ -0,0 +1,49 @@
+package ucloud
+
+import (
+	"expvar"
+	"sync"
+	"time"
+)
+
+// APICall is the timing and outcome of a UCloud API call, the retries are
+// included in the duration
+type APICall struct {
+	Action   string
+	Duration time.Duration
+	RetCode  int // RetCode of the failed response, 0 if it is not known
+	Err      error
+}
+
+var (
+	apiCallHookMu sync.Mutex
+	apiCallHook   func(APICall)
+)
+
+// SetAPICallHook set the function called after every UCloud API call, the
+// tooling built on driver can use it to export the metrics, nil removes it
+func SetAPICallHook(hook func(APICall)) {
+	apiCallHookMu.Lock()
+	defer apiCallHookMu.Unlock()
+	apiCallHook = hook
+}
+
+// apiCallStats is the count, error count and total milliseconds of the calls
+// by action, it is published as the expvar ucloud_api_calls
+var apiCallStats = expvar.NewMap("ucloud_api_calls")
+
+// recordAPICall add the call to the stats and pass it to the hook
+func recordAPICall(call APICall) {
+	apiCallStats.Add(call.Action+".count", 1)
+	apiCallStats.Add(call.Action+".duration_ms", call.Duration.Milliseconds())
+	if call.Err != nil {
+		apiCallStats.Add(call.Action+".errors", 1)
+	}
+
+	apiCallHookMu.Lock()
+	hook := apiCallHook
+	apiCallHookMu.Unlock()
+	if hook != nil {
+		hook(call)
+	}
+}
@@ -0,0 +1,29 @@
+package ucloud
+
+import (
+	"context"
+	"testing"
+)
+
+func TestAPICallHook(t *testing.T) {
+	var calls []APICall
+	SetAPICallHook(func(call APICall) { calls = append(calls, call) })
+	defer SetAPICallHook(nil)
+
+	d := NewDriver("ucloud-machine", "")
+	d.RetryCount = 1
+	d.call(context.Background(), "TestAction", nil, func(ctx context.Context) (interface{}, error) {
+		return nil, retCodeError(230)
+	})
+
+	if len(calls) != 1 {
+		t.Fatalf("expected 1 call, got:%d", len(calls))
+	}
+	if calls[0].Action != "TestAction" || calls[0].RetCode != 230 || calls[0].Err == nil {
+		t.Errorf("unexpected call:%+v", calls[0])
+	}
+
+	if v := apiCallStats.Get("TestAction.errors"); v == nil || v.String() != "1" {
+		t.Errorf("expected 1 error in stats, got:%v", v)
+	}
+}
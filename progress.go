@@ -0,0 +1,73 @@
+package ucloud
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/docker/machine/libmachine/log"
+)
+
+// createSteps are the steps of Create reported with progress
+var createSteps = []string{
+	"Creating key pair",
+	"Creating UHost",
+	"Waiting for UHost running",
+	"Attaching disks",
+	"Configuring networks",
+	"Uploading SSH key",
+	"Installing Docker",
+}
+
+// progress log the numbered steps with the elapsed time of each step and the
+// created resources, like "(2/7) Creating UHost done in 1.52s: uhost=uhost-xxx"
+type progress struct {
+	steps []string
+	n     int // the current step, from 1
+	start time.Time
+}
+
+func newProgress(steps []string) *progress {
+	return &progress{steps: steps}
+}
+
+// next start the next step
+func (p *progress) next() {
+	p.n++
+	p.start = time.Now()
+	log.Info(p.message("..."))
+}
+
+// done finish the current step, the empty resources are omitted
+func (p *progress) done(resources ...string) {
+	msg := p.message(fmt.Sprintf(" done in %s", time.Since(p.start).Round(10*time.Millisecond)))
+
+	var created []string
+	for _, r := range resources {
+		if r != "" {
+			created = append(created, r)
+		}
+	}
+	if len(created) > 0 {
+		msg += ": " + strings.Join(created, " ")
+	}
+	log.Info(msg)
+}
+
+// skip pass the next step with the reason
+func (p *progress) skip(reason string) {
+	p.n++
+	log.Info(p.message(" skipped, " + reason))
+}
+
+func (p *progress) message(status string) string {
+	return fmt.Sprintf("(%d/%d) %s%s", p.n, len(p.steps), p.steps[p.n-1], status)
+}
+
+// resource format the resource for progress, it is empty if id is not set
+func resource(kind, id string) string {
+	if id == "" {
+		return ""
+	}
+	return strings.Replace(kind, " ", "-", -1) + "=" + id
+}
@@ -0,0 +1,23 @@
+package ucloud
+
+import "testing"
+
+func TestProgress(t *testing.T) {
+	p := newProgress(createSteps)
+	p.next()
+	if msg := p.message("..."); msg != "(1/7) Creating key pair..." {
+		t.Errorf("unexpected message:%s", msg)
+	}
+
+	p.skip("no key")
+	if msg := p.message(""); msg != "(2/7) Creating UHost" {
+		t.Errorf("unexpected message:%s", msg)
+	}
+
+	if r := resource("security group", "123"); r != "security-group=123" {
+		t.Errorf("unexpected resource:%s", r)
+	}
+	if r := resource("EIP", ""); r != "" {
+		t.Errorf("the resource without id should be empty, got:%s", r)
+	}
+}
@@ -0,0 +1,263 @@
+package ucloud
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/docker/machine/libmachine/state"
+)
+
+// recordEnv enables recording the fixtures against the real UCloud API with
+// the keys in UCLOUD_PUBLIC_KEY and UCLOUD_PRIVATE_KEY
+const recordEnv = "UCLOUD_RECORD"
+
+// interaction is a recorded API request and its response
+type interaction struct {
+	Action   string `json:"action"`
+	Request  string `json:"request"`
+	Status   int    `json:"status"`
+	Response string `json:"response"`
+}
+
+// recorder is the http.RoundTripper which records the API interactions into
+// testdata/fixtures in record mode and replays them otherwise. The requests
+// of an action are replayed in order, the requests of different actions may
+// be sent concurrently by the driver.
+type recorder struct {
+	t            *testing.T
+	path         string
+	record       bool
+	transport    http.RoundTripper
+	interactions []interaction
+	replayed     []bool
+	sent         []url.Values // the replayed requests
+	mu           sync.Mutex
+}
+
+// newRecorder load the fixture of the test, the recorder is injected as the
+// transport of the driver. The test is skipped if the fixture is not recorded
+// yet.
+func newRecorder(t *testing.T, name string) *recorder {
+	r := &recorder{
+		t:         t,
+		path:      filepath.Join("testdata", "fixtures", name+".json"),
+		record:    os.Getenv(recordEnv) != "",
+		transport: http.DefaultTransport,
+	}
+
+	if !r.record {
+		b, err := ioutil.ReadFile(r.path)
+		if os.IsNotExist(err) {
+			t.Skipf("fixture %s is not recorded, set %s=1 with the real keys to record it", r.path, recordEnv)
+		}
+		if err != nil {
+			t.Fatalf("read fixture failed:%s", err)
+		}
+		if err := json.Unmarshal(b, &r.interactions); err != nil {
+			t.Fatalf("parse fixture failed:%s", err)
+		}
+		r.replayed = make([]bool, len(r.interactions))
+	}
+
+	t.Cleanup(func() {
+		if r.record {
+			r.save()
+			return
+		}
+		r.checkReplayed()
+	})
+
+	return r
+}
+
+// newReplayer replay the interactions given by the test, the requests are kept
+// in sent so their params can be checked
+func newReplayer(t *testing.T, interactions ...interaction) *recorder {
+	r := &recorder{
+		t:            t,
+		interactions: interactions,
+		replayed:     make([]bool, len(interactions)),
+	}
+	t.Cleanup(r.checkReplayed)
+
+	return r
+}
+
+// replay get the successful interaction of action, fields is the JSON fields
+// of the response besides the common ones
+func replay(action, fields string) interaction {
+	response := fmt.Sprintf(`{"Action":"%sResponse","RetCode":0`, action)
+	if fields != "" {
+		response += "," + fields
+	}
+
+	return interaction{Action: action, Status: http.StatusOK, Response: response + "}"}
+}
+
+func (r *recorder) checkReplayed() {
+	for i, replayed := range r.replayed {
+		if !replayed {
+			r.t.Errorf("interaction %d %s is not replayed", i, r.interactions[i].Action)
+		}
+	}
+}
+
+func (r *recorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	params, err := requestParams(req)
+	if err != nil {
+		return nil, err
+	}
+	action := params.Get("Action")
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.record {
+		resp, err := r.transport.RoundTrip(req)
+		if err != nil {
+			return nil, err
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+		r.interactions = append(r.interactions, interaction{
+			Action:   action,
+			Request:  redactParams(params),
+			Status:   resp.StatusCode,
+			Response: string(body),
+		})
+		return resp, nil
+	}
+
+	r.sent = append(r.sent, params)
+	i, ok := r.nextInteraction(action)
+	if !ok {
+		// a failed round trip looks like a network error and is retried, the
+		// unexpected request is rejected with a client error instead
+		r.t.Errorf("unexpected request %s, all of its interactions are replayed", action)
+		i = interaction{Action: action, Status: http.StatusBadRequest}
+	}
+
+	return &http.Response{
+		Status:     http.StatusText(i.Status),
+		StatusCode: i.Status,
+		Header:     http.Header{"Content-Type": []string{"application/json"}},
+		Body:       ioutil.NopCloser(bytes.NewReader([]byte(i.Response))),
+		Request:    req,
+	}, nil
+}
+
+// nextInteraction get the first interaction of action which is not replayed
+func (r *recorder) nextInteraction(action string) (interaction, bool) {
+	for n, i := range r.interactions {
+		if i.Action == action && !r.replayed[n] {
+			r.replayed[n] = true
+			return i, true
+		}
+	}
+
+	return interaction{}, false
+}
+
+func (r *recorder) save() {
+	if err := os.MkdirAll(filepath.Dir(r.path), 0755); err != nil {
+		r.t.Errorf("create fixture dir failed:%s", err)
+		return
+	}
+	b, err := json.MarshalIndent(r.interactions, "", "  ")
+	if err != nil {
+		r.t.Errorf("marshal fixture failed:%s", err)
+		return
+	}
+	if err := ioutil.WriteFile(r.path, b, 0644); err != nil {
+		r.t.Errorf("write fixture failed:%s", err)
+	}
+}
+
+// requestParams get the API params from the query and form body of request
+func requestParams(req *http.Request) (url.Values, error) {
+	params := req.URL.Query()
+	if req.Body == nil {
+		return params, nil
+	}
+
+	body, err := ioutil.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	req.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	form, err := url.ParseQuery(string(body))
+	if err != nil {
+		return params, nil
+	}
+	for k, v := range form {
+		params[k] = v
+	}
+
+	return params, nil
+}
+
+// redactParams encode the params with the keys and secrets redacted, so the
+// fixtures can be committed
+func redactParams(params url.Values) string {
+	redacted := url.Values{}
+	for k, v := range params {
+		if isSecretField(k) || k == "PublicKey" {
+			redacted.Set(k, redactedValue)
+			continue
+		}
+		redacted[k] = v
+	}
+
+	return redacted.Encode()
+}
+
+func TestIntegrationLifecycle(t *testing.T) {
+	r := newRecorder(t, "lifecycle")
+
+	d, _ := newFakeDriver(t)
+	d.client = nil
+	d.transport = r
+	d.PublicKey, d.PrivateKey = "public-key", "private-key"
+	if r.record {
+		d.PublicKey, d.PrivateKey = os.Getenv("UCLOUD_PUBLIC_KEY"), os.Getenv("UCLOUD_PRIVATE_KEY")
+	} else {
+		d.PollInterval = 1
+		delay := retryBaseDelay
+		retryBaseDelay = time.Millisecond
+		t.Cleanup(func() { retryBaseDelay = delay })
+	}
+	d.Region = defaultRegion
+	d.ImageName = defaultImageName
+	d.ChargeType = "Dynamic"
+	d.EIPChargeMode = defaultEIPChargeMode
+	d.EIPBandwidth = defaultEIPBandwidth
+	d.SecurityGroupName = "docker-machine-test"
+
+	if err := d.PreCreateCheck(); err != nil {
+		t.Fatalf("pre-create check failed:%s", err)
+	}
+	if err := d.Create(); err != nil {
+		t.Fatalf("create failed:%s", err)
+	}
+	assertState(t, d, state.Running)
+
+	if err := d.Remove(); err != nil {
+		t.Fatalf("remove failed:%s", err)
+	}
+}
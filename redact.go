@@ -0,0 +1,81 @@
+package ucloud
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// redactedValue replaces the secrets in the debug logs
+const redactedValue = "******"
+
+// secretFields are the lower case substrings of the field names whose values
+// must not be logged
+var secretFields = []string{
+	"privatekey",
+	"password",
+	"signature",
+	"securitytoken",
+	"userdata",
+}
+
+func isSecretField(name string) bool {
+	name = strings.ToLower(name)
+	for _, field := range secretFields {
+		if strings.Contains(name, field) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// redact get the JSON of v with the values of secret fields redacted, it is
+// used to log the API requests and responses
+func redact(v interface{}) string {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprintf("<%T>", v)
+	}
+
+	var data interface{}
+	if err := json.Unmarshal(b, &data); err != nil {
+		return fmt.Sprintf("<%T>", v)
+	}
+
+	b, err = json.Marshal(redactValue(data))
+	if err != nil {
+		return fmt.Sprintf("<%T>", v)
+	}
+
+	return string(b)
+}
+
+func redactValue(v interface{}) interface{} {
+	switch value := v.(type) {
+	case map[string]interface{}:
+		for k, field := range value {
+			if isSecretField(k) {
+				value[k] = redactedValue
+				continue
+			}
+			value[k] = redactValue(field)
+		}
+	case []interface{}:
+		for i, item := range value {
+			value[i] = redactValue(item)
+		}
+	}
+
+	return v
+}
+
+// mask keep the last 4 characters of the secret, so the key can still be
+// recognized in the logs
+func mask(secret string) string {
+	if len(secret) <= 8 {
+		return redactedValue
+	}
+
+	return redactedValue + secret[len(secret)-4:]
+}
@@ -0,0 +1,35 @@
+package ucloud
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRedact(t *testing.T) {
+	params := struct {
+		Region   string
+		Password string
+		Disks    []map[string]string
+	}{
+		Region:   "cn-north-03",
+		Password: "secret-password",
+		Disks:    []map[string]string{{"Type": "LOCAL_NORMAL", "PrivateKey": "secret-key"}},
+	}
+
+	s := redact(&params)
+	if strings.Contains(s, "secret") {
+		t.Errorf("the secrets should be redacted, got:%s", s)
+	}
+	if !strings.Contains(s, "cn-north-03") || !strings.Contains(s, "LOCAL_NORMAL") {
+		t.Errorf("the other fields should be kept, got:%s", s)
+	}
+}
+
+func TestMask(t *testing.T) {
+	if m := mask("short"); m != redactedValue {
+		t.Errorf("short secret should be redacted fully, got:%s", m)
+	}
+	if m := mask("0123456789abcdef"); m != redactedValue+"cdef" {
+		t.Errorf("expected the last 4 characters kept, got:%s", m)
+	}
+}
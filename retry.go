@@ -0,0 +1,237 @@
+package ucloud
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/docker/machine/libmachine/log"
+)
+
+// retCodeRateLimited is the RetCode of UCloud API when the requests of the
+// key exceed the QPS limit
+const retCodeRateLimited = 172
+
+// retCodeSignatureError is the RetCode of UCloud API when the key pair or the
+// security token is invalid
+const retCodeSignatureError = 171
+
+// idempotentPrefixes are the prefixes of the actions which read or delete
+// resources, they can be sent again after the request fails in flight
+var idempotentPrefixes = []string{"Describe", "Get", "Delete", "Terminate", "Release"}
+
+// retCodeNoStock is the RetCode of CreateUHostInstance when the zone has sold
+// out the UHost of the machine type and configuration
+const retCodeNoStock = 8039
+
+var (
+	retryBaseDelay = 1 * time.Second
+	retryMaxDelay  = 30 * time.Second
+)
+
+// statusCoder is implemented by the errors which carry the HTTP status code
+// of the API response
+type statusCoder interface {
+	StatusCode() int
+}
+
+// retCoder is implemented by the errors which carry the RetCode of the API
+// response
+type retCoder interface {
+	RetCode() int
+}
+
+// isRetryableError check whether the API call should be retried, only the
+// network errors, 5xx responses and rate limited responses are retryable. The
+// timed out request is not retried, it may be handled after it is canceled.
+func isRetryableError(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return !netErr.Timeout()
+	}
+
+	var sc statusCoder
+	if errors.As(err, &sc) && sc.StatusCode() >= 500 {
+		return true
+	}
+
+	var rc retCoder
+	if errors.As(err, &rc) && rc.RetCode() == retCodeRateLimited {
+		return true
+	}
+
+	return false
+}
+
+// isUnknownOutcome check whether the request may be handled by the API though
+// it fails, like the timed out request and the connection reset before the
+// response
+func isUnknownOutcome(err error) bool {
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+
+	var sc statusCoder
+	return errors.As(err, &sc) && sc.StatusCode() >= 500
+}
+
+// isRejectedError check whether the request is rejected before it is handled,
+// the request of any action can be sent again then
+func isRejectedError(err error) bool {
+	var rc retCoder
+	return errors.As(err, &rc) && rc.RetCode() == retCodeRateLimited
+}
+
+// isIdempotent check whether sending the action again has no more effect, the
+// actions creating or changing resources are not idempotent
+func isIdempotent(action string) bool {
+	for _, prefix := range idempotentPrefixes {
+		if strings.HasPrefix(action, prefix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// backoff get the jittered exponential delay before the next attempt
+func backoff(attempt int) time.Duration {
+	delay := retryBaseDelay << uint(attempt)
+	if delay <= 0 || delay > retryMaxDelay {
+		delay = retryMaxDelay
+	}
+
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// retry call fn until it succeeds, returns an error which is not retryable,
+// ctx is done or the attempts are used up.
+func retry(ctx context.Context, attempts int, retryable func(error) bool, fn func() (interface{}, error)) (interface{}, error) {
+	var resp interface{}
+	var err error
+	for i := 0; i < attempts; i++ {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		if resp, err = fn(); err == nil || !retryable(err) {
+			return resp, err
+		}
+
+		if i < attempts-1 {
+			delay := backoff(i)
+			log.Debugf("API call failed:%s, retry in %s", err, delay)
+			select {
+			case <-time.After(delay):
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		}
+	}
+
+	return nil, err
+}
+
+// retrySSH call fn until it succeeds or the attempts are used up, the delay
+// starts from interval and is doubled after every failure up to retryMaxDelay,
+// the sshd may refuse the connections while it is restarted at boot
+func retrySSH(attempts int, interval time.Duration, fn func() error) error {
+	var err error
+	delay := interval
+	for i := 0; i < attempts; i++ {
+		if err = fn(); err == nil {
+			return nil
+		}
+
+		if i < attempts-1 {
+			log.Debugf("SSH command failed:%s, retry in %s", err, delay)
+			time.Sleep(delay)
+			if delay *= 2; delay > retryMaxDelay {
+				delay = retryMaxDelay
+			}
+		}
+	}
+
+	return fmt.Errorf("failed after %d attempts:%w", attempts, err)
+}
+
+// call the API action with retries, the request and response are logged at
+// debug level with the secrets redacted, and the duration is recorded. Only
+// the rejected requests of the actions which are not idempotent are retried,
+// the other failures may happen after the request is handled. fn sends the
+// request with the ctx it gets, which is canceled after defaultTimeout.
+func (d *Driver) call(ctx context.Context, action string, params interface{}, fn func(context.Context) (interface{}, error)) (interface{}, error) {
+	log.Debugf("%s request: %s", action, redact(params))
+
+	retryable := isRejectedError
+	if isIdempotent(action) {
+		retryable = isRetryableError
+	}
+
+	start := time.Now()
+	resp, err := retry(ctx, d.retries(), retryable, func() (interface{}, error) {
+		ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+		defer cancel()
+		return fn(ctx)
+	})
+	call := APICall{Action: action, Duration: time.Since(start), Err: err}
+	var rc retCoder
+	if errors.As(err, &rc) {
+		call.RetCode = rc.RetCode()
+	}
+	recordAPICall(call)
+
+	if err != nil {
+		log.Debugf("%s failed in %s: %s", action, call.Duration, err)
+		if rc != nil && rc.RetCode() == retCodeSignatureError {
+			return resp, &Error{Cause: ErrAuthFailed, Message: err.Error()}
+		}
+		return resp, err
+	}
+
+	log.Debugf("%s response in %s: %s", action, call.Duration, redact(resp))
+	return resp, nil
+}
+
+// create call the action creating a resource, the request which fails in
+// flight may have created the resource, so find looks it up before the action
+// is sent again, the timed out action is not sent again even if nothing is
+// found. find returns the response of the found resource or nil if it
+// is not created.
+func (d *Driver) create(ctx context.Context, action string, params interface{}, fn func(context.Context) (interface{}, error), find func(context.Context) (interface{}, error)) (interface{}, error) {
+	for i := 0; ; i++ {
+		resp, err := d.call(ctx, action, params, fn)
+		if err == nil || !isUnknownOutcome(err) {
+			return resp, err
+		}
+
+		found, findErr := find(ctx)
+		if findErr != nil {
+			return nil, fmt.Errorf("%w, and look up the created resource failed:%s", err, findErr)
+		}
+		if found != nil {
+			log.Infof("%s failed: %s, but the resource is created", action, err)
+			return found, nil
+		}
+
+		if !isRetryableError(err) || i >= d.retries()-1 {
+			return nil, err
+		}
+		delay := backoff(i)
+		log.Debugf("%s failed:%s, the resource is not created, retry in %s", action, err, delay)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,262 @@
+package ucloud
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+type timeoutError struct{}
+
+func (e timeoutError) Error() string   { return "i/o timeout" }
+func (e timeoutError) Timeout() bool   { return true }
+func (e timeoutError) Temporary() bool { return true }
+
+type connError struct{}
+
+func (e connError) Error() string   { return "connection reset by peer" }
+func (e connError) Timeout() bool   { return false }
+func (e connError) Temporary() bool { return true }
+
+type statusError int
+
+func (e statusError) Error() string   { return "status error" }
+func (e statusError) StatusCode() int { return int(e) }
+
+// hangingTransport never answers, the request returns only when its context
+// is done
+type hangingTransport struct{}
+
+func (hangingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	<-req.Context().Done()
+	return nil, req.Context().Err()
+}
+
+type retCodeError int
+
+func (e retCodeError) Error() string { return "ret code error" }
+func (e retCodeError) RetCode() int  { return int(e) }
+
+func TestIsRetryableError(t *testing.T) {
+	cases := []struct {
+		err       error
+		retryable bool
+	}{
+		{nil, false},
+		{errors.New("invalid params"), false},
+		{timeoutError{}, false},
+		{context.DeadlineExceeded, false},
+		{connError{}, true},
+		{statusError(502), true},
+		{statusError(400), false},
+		{retCodeError(retCodeRateLimited), true},
+		{retCodeError(230), false},
+		{fmt.Errorf("describe failed:%w", connError{}), true},
+		{fmt.Errorf("describe failed:%w", statusError(502)), true},
+		{fmt.Errorf("describe failed:%w", retCodeError(retCodeRateLimited)), true},
+	}
+
+	for _, c := range cases {
+		if isRetryableError(c.err) != c.retryable {
+			t.Errorf("expected retryable:%t for error:%v", c.retryable, c.err)
+		}
+	}
+}
+
+func TestRetry(t *testing.T) {
+	retryBaseDelay = time.Millisecond
+	defer func() { retryBaseDelay = 1 * time.Second }()
+	ctx := context.Background()
+
+	calls := 0
+	resp, err := retry(ctx, 3, isRetryableError, func() (interface{}, error) {
+		calls++
+		if calls < 2 {
+			return nil, connError{}
+		}
+		return "ok", nil
+	})
+	if err != nil || calls != 2 || resp != "ok" {
+		t.Errorf("expected success after 2 calls, got calls:%d, resp:%v, err:%v", calls, resp, err)
+	}
+
+	calls = 0
+	_, err = retry(ctx, 3, isRetryableError, func() (interface{}, error) {
+		calls++
+		return nil, statusError(500)
+	})
+	if err == nil || calls != 3 {
+		t.Errorf("expected failure after 3 calls, got calls:%d, err:%v", calls, err)
+	}
+
+	calls = 0
+	_, err = retry(ctx, 3, isRetryableError, func() (interface{}, error) {
+		calls++
+		return nil, errors.New("invalid params")
+	})
+	if err == nil || calls != 1 {
+		t.Errorf("expected failure after 1 call, got calls:%d, err:%v", calls, err)
+	}
+}
+
+func TestIsIdempotent(t *testing.T) {
+	for action, idempotent := range map[string]bool{
+		"DescribeUHostInstance": true,
+		"GetRegion":             true,
+		"DeleteSecurityGroup":   true,
+		"ReleaseEIP":            true,
+		"CreateUHostInstance":   false,
+		"AllocateEIP":           false,
+		"BindEIP":               false,
+	} {
+		if isIdempotent(action) != idempotent {
+			t.Errorf("expected idempotent:%t for action:%s", idempotent, action)
+		}
+	}
+}
+
+func TestCallNotIdempotent(t *testing.T) {
+	retryBaseDelay = time.Millisecond
+	defer func() { retryBaseDelay = 1 * time.Second }()
+	d := NewDriver("ucloud-machine", "")
+	ctx := context.Background()
+
+	calls := 0
+	_, err := d.call(ctx, "AllocateEIP", nil, func(ctx context.Context) (interface{}, error) {
+		calls++
+		return nil, statusError(502)
+	})
+	if err == nil || calls != 1 {
+		t.Errorf("the failed create should not be retried, got calls:%d, err:%v", calls, err)
+	}
+
+	calls = 0
+	_, err = d.call(ctx, "AllocateEIP", nil, func(ctx context.Context) (interface{}, error) {
+		calls++
+		if calls < 2 {
+			return nil, retCodeError(retCodeRateLimited)
+		}
+		return "ok", nil
+	})
+	if err != nil || calls != 2 {
+		t.Errorf("the rate limited create should be retried, got calls:%d, err:%v", calls, err)
+	}
+}
+
+func TestCallAuthFailed(t *testing.T) {
+	d := NewDriver("ucloud-machine", "")
+	_, err := d.call(context.Background(), "DescribeUHostInstance", nil, func(ctx context.Context) (interface{}, error) {
+		return nil, fmt.Errorf("sign request failed:%w", retCodeError(retCodeSignatureError))
+	})
+	if !errors.Is(err, ErrAuthFailed) {
+		t.Errorf("the wrapped signature error should be ErrAuthFailed, got:%v", err)
+	}
+}
+
+func TestCreate(t *testing.T) {
+	retryBaseDelay = time.Millisecond
+	defer func() { retryBaseDelay = 1 * time.Second }()
+	d := NewDriver("ucloud-machine", "")
+	ctx := context.Background()
+
+	calls, finds := 0, 0
+	resp, err := d.create(ctx, "CreateUHostInstance", nil, func(ctx context.Context) (interface{}, error) {
+		calls++
+		return nil, statusError(502)
+	}, func(ctx context.Context) (interface{}, error) {
+		finds++
+		return "found", nil
+	})
+	if err != nil || resp != "found" || calls != 1 || finds != 1 {
+		t.Errorf("the created resource should be found, got calls:%d, finds:%d, resp:%v, err:%v", calls, finds, resp, err)
+	}
+
+	calls, finds = 0, 0
+	resp, err = d.create(ctx, "CreateUHostInstance", nil, func(ctx context.Context) (interface{}, error) {
+		calls++
+		if calls < 2 {
+			return nil, statusError(502)
+		}
+		return "created", nil
+	}, func(ctx context.Context) (interface{}, error) {
+		finds++
+		return nil, nil
+	})
+	if err != nil || resp != "created" || calls != 2 || finds != 1 {
+		t.Errorf("the create should be retried if nothing is found, got calls:%d, finds:%d, resp:%v, err:%v", calls, finds, resp, err)
+	}
+
+	calls, finds = 0, 0
+	_, err = d.create(ctx, "CreateUHostInstance", nil, func(ctx context.Context) (interface{}, error) {
+		calls++
+		return nil, timeoutError{}
+	}, func(ctx context.Context) (interface{}, error) {
+		finds++
+		return nil, nil
+	})
+	if err == nil || calls != 1 || finds != 1 {
+		t.Errorf("the timed out create should be looked up but not retried, got calls:%d, finds:%d, err:%v", calls, finds, err)
+	}
+}
+
+func TestRetryCanceled(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	calls := 0
+	_, err := retry(ctx, 3, isRetryableError, func() (interface{}, error) {
+		calls++
+		return nil, statusError(500)
+	})
+	if err != context.DeadlineExceeded || calls != 1 {
+		t.Errorf("expected error:%s after 1 call, got calls:%d, err:%v", context.DeadlineExceeded, calls, err)
+	}
+}
+
+func TestCallHangingCanceled(t *testing.T) {
+	d := NewDriver("ucloud-machine", "")
+	d.transport = hangingTransport{}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := d.getRegions(ctx)
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("the canceled request should fail")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the hanging request is not canceled with the context of the call")
+	}
+}
+
+func TestRetrySSH(t *testing.T) {
+	calls := 0
+	err := retrySSH(3, time.Millisecond, func() error {
+		calls++
+		if calls < 3 {
+			return errors.New("connection refused")
+		}
+		return nil
+	})
+	if err != nil || calls != 3 {
+		t.Errorf("expected success after 3 calls, got calls:%d err:%v", calls, err)
+	}
+
+	calls = 0
+	err = retrySSH(2, time.Millisecond, func() error {
+		calls++
+		return errors.New("connection refused")
+	})
+	if err == nil || calls != 2 {
+		t.Errorf("expected failure after 2 calls, got calls:%d err:%v", calls, err)
+	}
+}
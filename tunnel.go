@@ -0,0 +1,302 @@
+package ucloud
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/machine/libmachine/log"
+	"golang.org/x/crypto/ssh"
+)
+
+const defaultBastionUser = "root"
+
+// bastionHostKeyFile is the host key of bastion recorded in the machine
+// directory at the first connection
+const bastionHostKeyFile = "bastion_host_key"
+
+// sshTunnel forward the connections to a local port to the SSH port of uhost,
+// it is used when the uhost can not be reached directly. The tunnel lives in
+// the driver process, so it is set up again for every docker-machine command.
+type sshTunnel struct {
+	listener net.Listener
+	dialer   dialer
+	mu       sync.Mutex // dial is not called concurrently
+	wg       sync.WaitGroup
+}
+
+// dialer connect the SSH port of uhost for a tunnel, close release the
+// connections shared by the dials
+type dialer interface {
+	dial() (net.Conn, error)
+	close() error
+}
+
+// dialFunc is the dialer without shared connections
+type dialFunc func() (net.Conn, error)
+
+func (f dialFunc) dial() (net.Conn, error) { return f() }
+func (f dialFunc) close() error            { return nil }
+
+// newSSHTunnel listen on a random local port and forward the connections with
+// dialer
+func newSSHTunnel(dialer dialer) (*sshTunnel, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, fmt.Errorf("listen local port failed:%w", err)
+	}
+
+	t := &sshTunnel{listener: listener, dialer: dialer}
+	go t.serve()
+	return t, nil
+}
+
+// port get the local port of tunnel
+func (t *sshTunnel) port() int {
+	return t.listener.Addr().(*net.TCPAddr).Port
+}
+
+func (t *sshTunnel) serve() {
+	for {
+		local, err := t.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		t.wg.Add(1)
+		go func() {
+			defer t.wg.Done()
+			t.forward(local)
+		}()
+	}
+}
+
+func (t *sshTunnel) forward(local net.Conn) {
+	defer local.Close()
+
+	t.mu.Lock()
+	remote, err := t.dialer.dial()
+	t.mu.Unlock()
+	if err != nil {
+		log.Warnf("Unable to connect the SSH tunnel: %s", err)
+		return
+	}
+	defer remote.Close()
+
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(remote, local)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(local, remote)
+		done <- struct{}{}
+	}()
+	<-done
+}
+
+// close stop accepting the connections, wait for the forwarded ones and close
+// the dialer
+func (t *sshTunnel) close() error {
+	err := t.listener.Close()
+	t.wg.Wait()
+	if dialerErr := t.dialer.close(); err == nil {
+		err = dialerErr
+	}
+	return err
+}
+
+// useTunnel check whether SSH to the uhost goes through the tunnel
+func (d *Driver) useTunnel() bool {
+	return d.BastionHost != "" || d.SSHProxyCommand != ""
+}
+
+// sshTunnel get the tunnel to the SSH port of uhost, it is set up at the
+// first call
+func (d *Driver) sshTunnel() (*sshTunnel, error) {
+	if d.tunnel != nil {
+		return d.tunnel, nil
+	}
+
+	var dialer dialer = &bastionDialer{d: d}
+	if d.SSHProxyCommand != "" {
+		dialer = d.proxyCommandDialer()
+	}
+
+	t, err := newSSHTunnel(dialer)
+	if err != nil {
+		return nil, err
+	}
+	log.Debugf("SSH tunnel to UHost %s is listening on port %d", d.UhostID, t.port())
+
+	d.tunnel = t
+	return t, nil
+}
+
+// closeTunnel close the tunnel to uhost if it is set up
+func (d *Driver) closeTunnel() {
+	if d.tunnel == nil {
+		return
+	}
+	if err := d.tunnel.close(); err != nil {
+		log.Debugf("close SSH tunnel failed:%s", err)
+	}
+	d.tunnel = nil
+}
+
+// bastionDialer connect the SSH port of uhost through the bastion host, the
+// private IP address is used since the uhost is in the VPC of bastion. The
+// connection to bastion is shared by the dials, it is made again if it is
+// dropped.
+type bastionDialer struct {
+	d      *Driver
+	client *ssh.Client
+}
+
+func (b *bastionDialer) dial() (net.Conn, error) {
+	ip := b.d.PrivateIPAddress
+	if ip == "" {
+		ip = b.d.IPAddress
+	}
+	port, _ := b.d.BaseDriver.GetSSHPort()
+	addr := net.JoinHostPort(ip, strconv.Itoa(port))
+
+	if b.client != nil {
+		conn, err := b.client.Dial("tcp", addr)
+		if err == nil {
+			return conn, nil
+		}
+		log.Debugf("connect %s from bastion host failed, reconnect the bastion host:%s", ip, err)
+		b.close()
+	}
+
+	if err := b.connect(); err != nil {
+		return nil, err
+	}
+	conn, err := b.client.Dial("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("connect %s from bastion host failed:%w", ip, err)
+	}
+	return conn, nil
+}
+
+// connect the bastion host, its host key is trusted on first use and
+// recorded in the machine directory
+func (b *bastionDialer) connect() error {
+	key, err := ioutil.ReadFile(b.d.BastionKey)
+	if err != nil {
+		return fmt.Errorf("read bastion key failed:%w", err)
+	}
+	signer, err := ssh.ParsePrivateKey(key)
+	if err != nil {
+		return fmt.Errorf("parse bastion key failed:%w", err)
+	}
+
+	hostKey := &hostKeyChecker{path: b.d.ResolveStorePath(bastionHostKeyFile)}
+	config := &ssh.ClientConfig{
+		User:            b.d.BastionUser,
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+		HostKeyCallback: hostKey.check,
+		Timeout:         defaultTimeout,
+	}
+	client, err := ssh.Dial("tcp", bastionAddress(b.d.BastionHost), config)
+	if err != nil {
+		return fmt.Errorf("connect bastion host %s failed:%w", b.d.BastionHost, err)
+	}
+	b.client = client
+	return nil
+}
+
+func (b *bastionDialer) close() error {
+	if b.client == nil {
+		return nil
+	}
+	err := b.client.Close()
+	b.client = nil
+	return err
+}
+
+// proxyCommandDialer get the dialer connecting the SSH port of uhost with the
+// stdin and stdout of the proxy command, like the ProxyCommand of OpenSSH
+func (d *Driver) proxyCommandDialer() dialer {
+	return dialFunc(func() (net.Conn, error) {
+		ip := d.IPAddress
+		if d.PrivateIPOnly {
+			ip = d.PrivateIPAddress
+		}
+		port, _ := d.BaseDriver.GetSSHPort()
+		return dialProxyCommand(proxyCommand(d.SSHProxyCommand, ip, port, d.GetSSHUsername()))
+	})
+}
+
+// proxyCommand expand the %h, %p, %r and %% tokens of OpenSSH in command
+func proxyCommand(command, host string, port int, user string) string {
+	return strings.NewReplacer(
+		"%%", "%",
+		"%h", host,
+		"%p", strconv.Itoa(port),
+		"%r", user,
+	).Replace(command)
+}
+
+// dialProxyCommand run the command with shell and connect its stdin and stdout
+func dialProxyCommand(command string) (net.Conn, error) {
+	log.Debugf("SSH proxy command: %s", command)
+	cmd := exec.Command("sh", "-c", command)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("start proxy command failed:%w", err)
+	}
+
+	return &commandConn{cmd: cmd, stdin: stdin, stdout: stdout}, nil
+}
+
+// commandConn is the net.Conn over the stdin and stdout of a command
+type commandConn struct {
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	stdout io.ReadCloser
+}
+
+func (c *commandConn) Read(b []byte) (int, error)  { return c.stdout.Read(b) }
+func (c *commandConn) Write(b []byte) (int, error) { return c.stdin.Write(b) }
+
+// Close stop the command, the exit error of killed command is ignored
+func (c *commandConn) Close() error {
+	err := c.stdin.Close()
+	c.cmd.Process.Kill()
+	c.cmd.Wait()
+	return err
+}
+
+type commandAddr struct{}
+
+func (commandAddr) Network() string { return "pipe" }
+func (commandAddr) String() string  { return "proxy-command" }
+
+func (c *commandConn) LocalAddr() net.Addr                { return commandAddr{} }
+func (c *commandConn) RemoteAddr() net.Addr               { return commandAddr{} }
+func (c *commandConn) SetDeadline(t time.Time) error      { return nil }
+func (c *commandConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *commandConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// bastionAddress append the default SSH port to the bastion host without port
+func bastionAddress(host string) string {
+	if _, _, err := net.SplitHostPort(host); err == nil {
+		return host
+	}
+	return net.JoinHostPort(host, "22")
+}
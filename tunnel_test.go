@@ -0,0 +1,136 @@
+package ucloud
+
+import (
+	"bufio"
+	"net"
+	"strconv"
+	"testing"
+)
+
+func TestSSHTunnel(t *testing.T) {
+	// the echo server stands for the SSH port of uhost
+	server, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	go func() {
+		for {
+			conn, err := server.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				line, _ := bufio.NewReader(conn).ReadString('\n')
+				conn.Write([]byte(line))
+			}()
+		}
+	}()
+
+	tunnel, err := newSSHTunnel(dialFunc(func() (net.Conn, error) {
+		return net.Dial("tcp", server.Addr().String())
+	}))
+	if err != nil {
+		t.Fatalf("create tunnel failed:%s", err)
+	}
+
+	conn, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(tunnel.port())))
+	if err != nil {
+		t.Fatalf("connect tunnel failed:%s", err)
+	}
+	if _, err := conn.Write([]byte("SSH-2.0-test\n")); err != nil {
+		t.Fatal(err)
+	}
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil || line != "SSH-2.0-test\n" {
+		t.Errorf("unexpected response:%q, err:%v", line, err)
+	}
+	conn.Close()
+
+	if err := tunnel.close(); err != nil {
+		t.Errorf("close tunnel failed:%s", err)
+	}
+}
+
+// closeDialer records whether it is closed
+type closeDialer struct {
+	closed bool
+}
+
+func (c *closeDialer) dial() (net.Conn, error) { return nil, net.ErrClosed }
+func (c *closeDialer) close() error {
+	c.closed = true
+	return nil
+}
+
+func TestCloseTunnel(t *testing.T) {
+	for name, op := range map[string]func(d *Driver) error{
+		"kill":   (*Driver).Kill,
+		"remove": (*Driver).Remove,
+	} {
+		d, _ := newFakeDriver(t)
+		if err := d.Create(); err != nil {
+			t.Fatalf("create failed:%s", err)
+		}
+		dialer := &closeDialer{}
+		tunnel, err := newSSHTunnel(dialer)
+		if err != nil {
+			t.Fatalf("create tunnel failed:%s", err)
+		}
+		d.tunnel = tunnel
+
+		if err := op(d); err != nil {
+			t.Fatalf("%s failed:%s", name, err)
+		}
+		if d.tunnel != nil || !dialer.closed {
+			t.Errorf("tunnel should be closed after %s", name)
+		}
+	}
+}
+
+func TestBastionAddress(t *testing.T) {
+	for host, expected := range map[string]string{
+		"10.10.0.5":      "10.10.0.5:22",
+		"10.10.0.5:2222": "10.10.0.5:2222",
+		"bastion.local":  "bastion.local:22",
+	} {
+		if addr := bastionAddress(host); addr != expected {
+			t.Errorf("expected %s, got %s", expected, addr)
+		}
+	}
+}
+
+func TestProxyCommandTunnel(t *testing.T) {
+	// cat echoes what is sent to the SSH port
+	d, _ := newFakeDriver(t)
+	d.IPAddress = "106.75.0.1"
+	d.SSHProxyCommand = "cat"
+
+	port, err := d.GetSSHPort()
+	if err != nil {
+		t.Fatalf("get SSH port failed:%s", err)
+	}
+	host, _ := d.GetSSHHostname()
+	conn, err := net.Dial("tcp", net.JoinHostPort(host, strconv.Itoa(port)))
+	if err != nil {
+		t.Fatalf("connect tunnel failed:%s", err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte("SSH-2.0-test\n")); err != nil {
+		t.Fatal(err)
+	}
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil || line != "SSH-2.0-test\n" {
+		t.Errorf("unexpected response:%q, err:%v", line, err)
+	}
+	conn.Close()
+	d.tunnel.close()
+}
+
+func TestProxyCommand(t *testing.T) {
+	command := proxyCommand("nc -X connect -x proxy:8080 %h %p # %r 100%%", "106.75.0.1", 22, "root")
+	if command != "nc -X connect -x proxy:8080 106.75.0.1 22 # root 100%" {
+		t.Errorf("unexpected command:%s", command)
+	}
+}
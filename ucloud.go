@@ -1,8 +1,13 @@
 package ucloud
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"net"
+	"net/http"
 	"net/url"
+	"os"
 	"strconv"
 	"strings"
 	"time"
@@ -17,33 +22,160 @@ import (
 type Driver struct {
 	*drivers.BaseDriver
 
+	client    ucloudClient
+	tunnel    *sshTunnel
+	transport http.RoundTripper // transport of the API requests, http.DefaultTransport if nil
+
+	// the last state of uhost and when it is got, see GetState
+	cachedState   state.State
+	cachedStateAt time.Time
+
 	PublicKey  string
 	PrivateKey string
-	Region     string
-	ImageId    string
-	Password   string
-	UhostID    string
+	ProjectId  string
+
+	APIEndpoint string
+
+	SecurityToken       string
+	SecurityTokenExpiry time.Time
+	Region              string
+	Zone                string
+	ImageId             string
+	ImageName           string
+	OsName              string
+	Password            string
+	UhostID             string
+
+	SSHPrivateKeyPath    string
+	BastionHost          string
+	BastionUser          string
+	BastionKey           string
+	SSHProxyCommand      string
+	DockerPort           int
+	DockerInstallURL     string
+	ConfigureSSHPort     bool
+	DisablePasswordLogin bool
+	KeyPairLogin         bool
+	ImportKeyPair        bool
+	KeyPairId            string
+	UMonAgentURL         string
+	AlarmTemplateId      string
+	UserDataFile         string
+	Tag                  string
+	Remark               string
+	DeleteProtection     bool
+	RemoveAllResources   bool
+
+	CPU            int
+	Memory         int
+	DiskSpace      int
+	ChargeType     string
+	ChargeDuration int
+	AutoRenew      bool
+	CouponId       string
+	MaxPrice       int
+	MachineType    string
+	Arch           string
+	Hotplug        bool
+	NetCapability  string
+
+	CreateTimeout int
+	StopTimeout   int
+	RetryCount    int
+	PollInterval  int
+	StateCacheTTL int
+
+	SSHRetries       int
+	SSHRetryInterval int
+	VerifyHostKey    bool
 
-	CPU        int
-	Memory     int
-	DiskSpace  int
-	ChargeType string
+	BootDiskType  string
+	DataDiskType  string
+	DataDiskSize  int
+	UDiskIds      []string
+	DiskIds       []string // disks created with uhost
+	KeepDataDisks bool
 
-	PrivateIPOnly     bool
-	PrivateIPAddress  string
-	SecurityGroupId   int
-	SecurityGroupName string
+	PrivateIPOnly      bool
+	PrivateIPAddress   string
+	StaticPrivateIP    string
+	SecondarySubnetId  string
+	NetworkInterfaceId string
+	SecondaryIPAddress string
+	SecondaryIPCount   int
+	SecondaryIPs       []string
+	IPv6               bool
+	IPv6Address        string
+	EIPId              string
+	ExistingEIP        bool
+	EIPChargeMode      string
+	EIPBandwidth       int
+	EIPOperator        string
+	ShareBandwidthId   string
+	SecurityGroupId    int
+	SecurityGroupName  string
+	SecurityGroupRules []string
+	OpenPorts          []string
+
+	SecurityGroupCreated bool
+
+	ULBId          string
+	ULBBackendPort int
+	ULBBackendIds  []string
+
+	VPCId         string
+	SubnetId      string
+	VPCCreated    bool
+	SubnetCreated bool
+
+	NATGWId       string
+	CreateNATGW   bool
+	NATGWCreated  bool
+	NATGWSubnetId string // subnet attached to the existing NAT gateway by driver
+
+	NATGWFirewallId      int
+	NATGWFirewallCreated bool
 }
 
 const (
-	defaultTimeout    = 1 * time.Second
+	defaultTimeout    = 30 * time.Second // timeout of every API call
 	defaultCPU        = 1
 	defaultMemory     = 2048
 	defaultDiskSpace  = 20
-	defaultRegion     = "cn-north-03"
+	defaultRegion     = "cn-bj2"
 	defaultChargeType = "Month"
-	defaultRetries    = 10
-	defaultImageId    = "uimage-aaee5e" // we use CentOS 7.0 default
+
+	defaultChargeDuration = 1
+	defaultRetries        = 10
+	defaultCreateTimeout  = 360        // seconds to wait for the uhost running
+	defaultStopTimeout    = 120        // seconds to wait for the graceful shutdown
+	defaultPollInterval   = 3          // seconds between polling the states
+	defaultStateCacheTTL  = 2          // seconds to cache the state of uhost
+	defaultSSHRetries     = 5          // attempts of the bootstrap SSH commands
+	defaultSSHRetryDelay  = 5          // seconds before the first SSH retry
+	defaultImageName      = "CentOS 7" // the newest CentOS 7 image of region is used by default
+	defaultDiskType       = "LOCAL_NORMAL"
+	defaultRemark         = "created by docker-machine"
+
+	// machine type of the Ampere ARM uhost
+	defaultARMMachineType = "A"
+
+	defaultEIPChargeMode = "PayByBandwidth"
+	defaultEIPBandwidth  = 2 // Mbps
+
+	defaultULBBackendPort = 80
+	defaultDockerPort     = 2376
+
+	// forceRemoveEnv allows removing the machine with delete protection
+	forceRemoveEnv = "UCLOUD_FORCE_REMOVE"
+
+	// official install script of Docker, it is used with the Aliyun mirror
+	// in the cn-* regions
+	officialDockerInstallURL = "https://get.docker.com"
+
+	defaultVPCNetwork    = "10.10.0.0/16"
+	defaultSubnet        = "10.10.0.0"
+	defaultSubnetNetmask = 24
 )
 
 var (
@@ -56,10 +188,12 @@ func NewDriver(hostName, artifactPath string) *Driver {
 			MachineName: hostName,
 			//ArtifactPath: artifactPath,
 		},
-		Region:    defaultRegion,
-		Memory:    defaultMemory,
-		CPU:       defaultCPU,
-		DiskSpace: defaultDiskSpace,
+		Region:       defaultRegion,
+		Memory:       defaultMemory,
+		CPU:          defaultCPU,
+		DiskSpace:    defaultDiskSpace,
+		EIPBandwidth: defaultEIPBandwidth,
+		Arch:         archX86,
 	}
 }
 
@@ -79,59 +213,439 @@ func (d *Driver) GetCreateFlags() []mcnflag.Flag {
 			EnvVar: "UCLOUD_PRIVATE_KEY",
 		},
 		mcnflag.StringFlag{
-			Name:  "ucloud-imageid",
-			Usage: "UHost image id",
-			Value: "",
+			Name:   "ucloud-security-token",
+			Usage:  "UCloud STS security token of the temporary public and private key",
+			Value:  "",
+			EnvVar: "UCLOUD_SECURITY_TOKEN",
+		},
+		mcnflag.StringFlag{
+			Name:   "ucloud-security-token-expiry",
+			Usage:  "Expiry time of the security token in RFC3339 format, such as 2016-01-02T15:04:05Z",
+			Value:  "",
+			EnvVar: "UCLOUD_SECURITY_TOKEN_EXPIRY",
+		},
+		mcnflag.StringFlag{
+			Name:   "ucloud-project-id",
+			Usage:  "UCloud project id, default project of the account will be used if not set",
+			Value:  "",
+			EnvVar: "UCLOUD_PROJECT_ID",
+		},
+		mcnflag.StringFlag{
+			Name:   "ucloud-api-endpoint",
+			Usage:  "Endpoint of UCloud API, default is https://api.ucloud.cn",
+			Value:  "",
+			EnvVar: "UCLOUD_API_ENDPOINT",
+		},
+		mcnflag.StringFlag{
+			Name:   "ucloud-imageid",
+			Usage:  "UHost image id",
+			Value:  "",
+			EnvVar: "UCLOUD_IMAGE_ID",
+		},
+		mcnflag.StringFlag{
+			Name:   "ucloud-image-name",
+			Usage:  "OS name of UHost image like \"Ubuntu 22.04\", the newest matching base image in region is used",
+			Value:  "",
+			EnvVar: "UCLOUD_IMAGE_NAME",
 		},
 		mcnflag.StringFlag{
 			Name:   "ucloud-region",
-			Usage:  "Region of ucloud idc",
-			Value:  "cn-north-03",
+			Usage:  "Region of ucloud idc, default is cn-bj2",
+			Value:  "",
 			EnvVar: "UCLOUD_REGION",
 		},
 		mcnflag.StringFlag{
-			Name:  "ucloud-ssh-user",
-			Usage: "SSH user",
-			Value: "root",
+			Name:   "ucloud-zone",
+			Usage:  "Availability zone in the region, a zone in stock of the UHost is chosen if not set",
+			Value:  "",
+			EnvVar: "UCLOUD_ZONE",
+		},
+		mcnflag.StringFlag{
+			Name:   "ucloud-ssh-user",
+			Usage:  "SSH user, the non-root user is created with sudo and docker permissions",
+			Value:  "root",
+			EnvVar: "UCLOUD_SSH_USER",
+		},
+		mcnflag.IntFlag{
+			Name:   "ucloud-cpu-core",
+			Usage:  "Number of CPU cores,default is 1",
+			Value:  defaultCPU,
+			EnvVar: "UCLOUD_CPU_CORE",
+		},
+		mcnflag.IntFlag{
+			Name:   "ucloud-memory-size",
+			Usage:  "Size of memory, unit(MB), default 2048M",
+			Value:  defaultMemory,
+			EnvVar: "UCLOUD_MEMORY_SIZE",
+		},
+		mcnflag.IntFlag{
+			Name:   "ucloud-disk-space",
+			Usage:  "Disk size, unit(GB), default is 20G",
+			Value:  defaultDiskSpace,
+			EnvVar: "UCLOUD_DISK_SPACE",
+		},
+		mcnflag.StringFlag{
+			Name:   "ucloud-machine-type",
+			Usage:  "UHost machine type, such as N, C, O, default machine type of the zone will be used if not set",
+			Value:  "",
+			EnvVar: "UCLOUD_MACHINE_TYPE",
+		},
+		mcnflag.StringFlag{
+			Name:   "ucloud-arch",
+			Usage:  "Architecture of UHost, you can chose from (x86_64,aarch64), the machine type is A for aarch64 if not set",
+			Value:  archX86,
+			EnvVar: "UCLOUD_ARCH",
+		},
+		mcnflag.StringFlag{
+			Name:   "ucloud-boot-disk-type",
+			Usage:  "Type of boot disk, you can chose from (LOCAL_NORMAL,LOCAL_SSD,CLOUD_SSD,CLOUD_RSSD)",
+			Value:  "",
+			EnvVar: "UCLOUD_BOOT_DISK_TYPE",
+		},
+		mcnflag.IntFlag{
+			Name:   "ucloud-data-disk-size",
+			Usage:  "Size of data disk, unit(GB), no data disk is created if not set",
+			Value:  0,
+			EnvVar: "UCLOUD_DATA_DISK_SIZE",
+		},
+		mcnflag.StringFlag{
+			Name:   "ucloud-data-disk-type",
+			Usage:  "Type of data disk, you can chose from (LOCAL_NORMAL,LOCAL_SSD,CLOUD_SSD,CLOUD_RSSD), default is LOCAL_NORMAL",
+			Value:  "",
+			EnvVar: "UCLOUD_DATA_DISK_TYPE",
+		},
+		mcnflag.StringSliceFlag{
+			Name:   "ucloud-udisk-id",
+			Usage:  "Id of an existing UDisk to attach, can be specified multiple times",
+			Value:  []string{},
+			EnvVar: "UCLOUD_UDISK_ID",
+		},
+		mcnflag.BoolFlag{
+			Name:   "ucloud-keep-data-disks",
+			Usage:  "Detach and keep the cloud data disks on remove, they are named <machine>-data-<n>",
+			EnvVar: "UCLOUD_KEEP_DATA_DISKS",
+		},
+		mcnflag.StringFlag{
+			Name:   "ucloud-charge-type",
+			Usage:  "How to pay for, you can chose from (Year,Month,Dynamic,Trial), default is Month",
+			Value:  defaultChargeType,
+			EnvVar: "UCLOUD_CHARGE_TYPE",
 		},
 		mcnflag.IntFlag{
-			Name:  "ucloud-cpu-core",
-			Usage: "Number of CPU cores,default is 1",
-			Value: defaultCPU,
+			Name:   "ucloud-charge-duration",
+			Usage:  "Purchase duration of Year and Month charge type, unit is the charge type, default is 1",
+			Value:  defaultChargeDuration,
+			EnvVar: "UCLOUD_CHARGE_DURATION",
 		},
 		mcnflag.IntFlag{
-			Name:  "ucloud-memory-size",
-			Usage: "Size of memory, unit(MB), default 2048M",
-			Value: defaultMemory,
+			Name:   "ucloud-create-timeout",
+			Usage:  "Seconds to wait for the UHost running after it is created",
+			Value:  defaultCreateTimeout,
+			EnvVar: "UCLOUD_CREATE_TIMEOUT",
 		},
 		mcnflag.IntFlag{
-			Name:  "ucloud-disk-space",
-			Usage: "Disk size, unit(GB), default is 20G",
-			Value: defaultDiskSpace,
+			Name:   "ucloud-stop-timeout",
+			Usage:  "Seconds to wait for the graceful shutdown before powering off the UHost",
+			Value:  defaultStopTimeout,
+			EnvVar: "UCLOUD_STOP_TIMEOUT",
+		},
+		mcnflag.IntFlag{
+			Name:   "ucloud-retry-count",
+			Usage:  "Max attempts of every UCloud API request",
+			Value:  defaultRetries,
+			EnvVar: "UCLOUD_RETRY_COUNT",
+		},
+		mcnflag.IntFlag{
+			Name:   "ucloud-poll-interval",
+			Usage:  "Seconds between polling the states of UHost and other resources",
+			Value:  defaultPollInterval,
+			EnvVar: "UCLOUD_POLL_INTERVAL",
+		},
+		mcnflag.IntFlag{
+			Name:   "ucloud-state-cache-ttl",
+			Usage:  "Seconds to cache the state of UHost between the status queries, 0 to disable",
+			Value:  defaultStateCacheTTL,
+			EnvVar: "UCLOUD_STATE_CACHE_TTL",
+		},
+		mcnflag.IntFlag{
+			Name:   "ucloud-ssh-retries",
+			Usage:  "Max attempts of uploading the SSH key with password",
+			Value:  defaultSSHRetries,
+			EnvVar: "UCLOUD_SSH_RETRIES",
+		},
+		mcnflag.IntFlag{
+			Name:   "ucloud-ssh-retry-interval",
+			Usage:  "Seconds before the first retry of uploading the SSH key, it is doubled after every failure",
+			Value:  defaultSSHRetryDelay,
+			EnvVar: "UCLOUD_SSH_RETRY_INTERVAL",
+		},
+		mcnflag.BoolFlag{
+			Name:   "ucloud-verify-host-key",
+			Usage:  "Record the host key of UHost at the first password SSH login and verify it in the later ones",
+			EnvVar: "UCLOUD_VERIFY_HOST_KEY",
+		},
+		mcnflag.BoolFlag{
+			Name:   "ucloud-hotplug",
+			Usage:  "Enable the hot migration and hotplug feature of UHost, the CPU and memory can be added without stopping it",
+			EnvVar: "UCLOUD_HOTPLUG",
+		},
+		mcnflag.StringFlag{
+			Name:   "ucloud-net-capability",
+			Usage:  "Network enhancement of UHost, value is Normal, Super or Ultra",
+			Value:  "",
+			EnvVar: "UCLOUD_NET_CAPABILITY",
+		},
+		mcnflag.BoolFlag{
+			Name:   "ucloud-auto-renew",
+			Usage:  "Renew the prepaid UHost automatically when it is expired",
+			EnvVar: "UCLOUD_AUTO_RENEW",
+		},
+		mcnflag.IntFlag{
+			Name:   "ucloud-max-price",
+			Usage:  "Max estimated price(CNY) per month of the UHost and EIP, the creation is aborted if it is exceeded, 0 to disable",
+			Value:  0,
+			EnvVar: "UCLOUD_MAX_PRICE",
+		},
+		mcnflag.StringFlag{
+			Name:   "ucloud-coupon-id",
+			Usage:  "Id of the coupon used to pay for UHost and EIP",
+			Value:  "",
+			EnvVar: "UCLOUD_COUPON_ID",
+		},
+		mcnflag.StringFlag{
+			Name:   "ucloud-ssh-key-path",
+			Usage:  "Path of an existing SSH private key, the public key is read from <path>.pub",
+			Value:  "",
+			EnvVar: "UCLOUD_SSH_KEY_PATH",
+		},
+		mcnflag.IntFlag{
+			Name:   "ucloud-docker-port",
+			Usage:  "Port of Docker daemon, it is opened in the security group created by driver",
+			Value:  defaultDockerPort,
+			EnvVar: "UCLOUD_DOCKER_PORT",
+		},
+		mcnflag.StringFlag{
+			Name:   "ucloud-docker-install-url",
+			Usage:  "HTTPS URL of the Docker install script run before provisioning, the official script with the Aliyun mirror is used in cn-* regions by default, none to disable it",
+			Value:  "",
+			EnvVar: "UCLOUD_DOCKER_INSTALL_URL",
+		},
+		mcnflag.IntFlag{
+			Name:   "ucloud-ssh-port",
+			Usage:  "SSH port",
+			Value:  22,
+			EnvVar: "UCLOUD_SSH_PORT",
+		},
+		mcnflag.StringFlag{
+			Name:   "ucloud-user-password",
+			Usage:  "Password of ucloud user, random password will be used if not set",
+			Value:  "",
+			EnvVar: "UCLOUD_USER_PASSWORD",
+		},
+		mcnflag.BoolFlag{
+			Name:   "ucloud-configure-ssh-port",
+			Usage:  "Reconfigure sshd to listen on --ucloud-ssh-port by cloud-init",
+			EnvVar: "UCLOUD_CONFIGURE_SSH_PORT",
+		},
+		mcnflag.BoolFlag{
+			Name:   "ucloud-disable-password-login",
+			Usage:  "Disable the SSH password login and lock the root password after the key is uploaded",
+			EnvVar: "UCLOUD_DISABLE_PASSWORD_LOGIN",
+		},
+		mcnflag.BoolFlag{
+			Name:   "ucloud-keypair-login",
+			Usage:  "Deprecated, the public key is installed at boot by default",
+			EnvVar: "UCLOUD_KEYPAIR_LOGIN",
+		},
+		mcnflag.BoolFlag{
+			Name:   "ucloud-upload-keypair",
+			Usage:  "Upload the public key with password after boot instead of installing it at boot, for the images without cloud-init",
+			EnvVar: "UCLOUD_UPLOAD_KEYPAIR",
+		},
+		mcnflag.BoolFlag{
+			Name:   "ucloud-import-keypair",
+			Usage:  "Import the public key into the UCloud KeyPair service for the rescue logins in the console",
+			EnvVar: "UCLOUD_IMPORT_KEYPAIR",
 		},
 		mcnflag.StringFlag{
-			Name:  "ucloud-charge-type",
-			Usage: "How to pay for, you can chose from (Year,Month,Dynamic,Trial), default is Month",
-			Value: defaultChargeType,
+			Name:   "ucloud-ulb-id",
+			Usage:  "Id of the existing ULB, the UHost is added as backend to all the vservers of it",
+			Value:  "",
+			EnvVar: "UCLOUD_ULB_ID",
 		},
 		mcnflag.IntFlag{
-			Name:  "ucloud-ssh-port",
-			Usage: "SSH port",
-			Value: 22,
+			Name:   "ucloud-ulb-backend-port",
+			Usage:  "Port of UHost as the ULB backend",
+			Value:  defaultULBBackendPort,
+			EnvVar: "UCLOUD_ULB_BACKEND_PORT",
+		},
+		mcnflag.StringFlag{
+			Name:   "ucloud-umon-agent-url",
+			Usage:  "HTTPS URL of the UMon monitoring agent install script run at boot, the agent is not installed if it is not set",
+			EnvVar: "UCLOUD_UMON_AGENT_URL",
+		},
+		mcnflag.StringFlag{
+			Name:   "ucloud-alarm-template-id",
+			Usage:  "Id of the existing UMon alarm template attached to UHost",
+			Value:  "",
+			EnvVar: "UCLOUD_ALARM_TEMPLATE_ID",
+		},
+		mcnflag.StringFlag{
+			Name:   "ucloud-userdata",
+			Usage:  "Path to file with cloud-init user data",
+			Value:  "",
+			EnvVar: "UCLOUD_USERDATA",
+		},
+		mcnflag.StringFlag{
+			Name:   "ucloud-tag",
+			Usage:  "Tag(business group) of UHost and the EIP, disks and VPC created by driver, default is Default",
+			Value:  "",
+			EnvVar: "UCLOUD_TAG",
+		},
+		mcnflag.StringFlag{
+			Name:   "ucloud-remark",
+			Usage:  "Remark of UHost, default is created by docker-machine",
+			Value:  defaultRemark,
+			EnvVar: "UCLOUD_REMARK",
+		},
+		mcnflag.BoolFlag{
+			Name:   "ucloud-delete-protection",
+			Usage:  "Protect the UHost from docker-machine rm unless UCLOUD_FORCE_REMOVE is set",
+			EnvVar: "UCLOUD_DELETE_PROTECTION",
+		},
+		mcnflag.BoolFlag{
+			Name:   "ucloud-remove-all-resources",
+			Usage:  "Delete the disks left by the UHost on remove and verify all the created resources are released",
+			EnvVar: "UCLOUD_REMOVE_ALL_RESOURCES",
+		},
+		mcnflag.BoolFlag{
+			Name:   "ucloud-private-address-only",
+			Usage:  "Only use a private IP address",
+			EnvVar: "UCLOUD_PRIVATE_ADDRESS_ONLY",
+		},
+		mcnflag.StringFlag{
+			Name:   "ucloud-natgw-id",
+			Usage:  "Id of an existing NAT gateway to attach the subnet of the private only UHost to",
+			Value:  "",
+			EnvVar: "UCLOUD_NATGW_ID",
+		},
+		mcnflag.BoolFlag{
+			Name:   "ucloud-create-natgw",
+			Usage:  "Create a NAT gateway for the subnet of the private only UHost, it is deleted with the machine",
+			EnvVar: "UCLOUD_CREATE_NATGW",
+		},
+		mcnflag.StringFlag{
+			Name:   "ucloud-bastion-host",
+			Usage:  "Bastion host[:port] in the VPC to SSH the UHost through, for the private only UHost",
+			Value:  "",
+			EnvVar: "UCLOUD_BASTION_HOST",
+		},
+		mcnflag.StringFlag{
+			Name:   "ucloud-bastion-user",
+			Usage:  "SSH user of the bastion host",
+			Value:  defaultBastionUser,
+			EnvVar: "UCLOUD_BASTION_USER",
+		},
+		mcnflag.StringFlag{
+			Name:   "ucloud-bastion-key",
+			Usage:  "SSH private key path of the bastion host",
+			Value:  "",
+			EnvVar: "UCLOUD_BASTION_KEY",
 		},
 		mcnflag.StringFlag{
-			Name:  "ucloud-user-password",
-			Usage: "Password of ucloud user, random password will be used if not set",
-			Value: "",
+			Name:   "ucloud-ssh-proxy-command",
+			Usage:  "ProxyCommand of OpenSSH used to SSH the UHost, %h and %p are replaced with the IP address and SSH port",
+			Value:  "",
+			EnvVar: "UCLOUD_SSH_PROXY_COMMAND",
+		},
+		mcnflag.StringFlag{
+			Name:   "ucloud-private-ip",
+			Usage:  "Static private IP address of UHost, it must be in the subnet",
+			Value:  "",
+			EnvVar: "UCLOUD_PRIVATE_IP",
 		},
 		mcnflag.BoolFlag{
-			Name:  "ucloud-private-address-only",
-			Usage: "Only use a private IP address",
+			Name:   "ucloud-ipv6",
+			Usage:  "Assign an IPv6 address to UHost, the VPC must be IPv6 enabled",
+			EnvVar: "UCLOUD_IPV6",
+		},
+		mcnflag.StringFlag{
+			Name:   "ucloud-eip-id",
+			Usage:  "Id of an existing EIP to bind, a new EIP will be allocated if not set",
+			Value:  "",
+			EnvVar: "UCLOUD_EIP_ID",
+		},
+		mcnflag.StringFlag{
+			Name:   "ucloud-eip-charge-mode",
+			Usage:  "Charge mode of the allocated EIP, you can chose from (PayByBandwidth,PayByTraffic), default is PayByBandwidth",
+			Value:  defaultEIPChargeMode,
+			EnvVar: "UCLOUD_EIP_CHARGE_MODE",
+		},
+		mcnflag.StringFlag{
+			Name:   "ucloud-eip-operator",
+			Usage:  "Operator of the allocated EIP (Bgp,International,Telecom,Unicom,Duplet), default is Bgp in cn-* regions and International in others",
+			Value:  "",
+			EnvVar: "UCLOUD_EIP_OPERATOR",
+		},
+		mcnflag.IntFlag{
+			Name:   "ucloud-eip-bandwidth",
+			Usage:  "Bandwidth(Mbps) of the allocated EIP",
+			Value:  defaultEIPBandwidth,
+			EnvVar: "UCLOUD_EIP_BANDWIDTH",
+		},
+		mcnflag.StringFlag{
+			Name:   "ucloud-share-bandwidth-id",
+			Usage:  "Id of an existing shared bandwidth package for the allocated EIP to join",
+			Value:  "",
+			EnvVar: "UCLOUD_SHARE_BANDWIDTH_ID",
+		},
+		mcnflag.StringFlag{
+			Name:   "ucloud-vpc-id",
+			Usage:  "Id of VPC to create UHost in, default network of the account will be used if not set",
+			Value:  "",
+			EnvVar: "UCLOUD_VPC_ID",
+		},
+		mcnflag.StringFlag{
+			Name:   "ucloud-subnet-id",
+			Usage:  "Id of subnet in the VPC to create UHost in",
+			Value:  "",
+			EnvVar: "UCLOUD_SUBNET_ID",
+		},
+		mcnflag.StringFlag{
+			Name:   "ucloud-secondary-subnet-id",
+			Usage:  "Id of subnet in the VPC of UHost to attach a secondary network interface in",
+			Value:  "",
+			EnvVar: "UCLOUD_SECONDARY_SUBNET_ID",
+		},
+		mcnflag.IntFlag{
+			Name:   "ucloud-secondary-ip-count",
+			Usage:  "Number of the secondary private IPs allocated on the primary network interface, for the macvlan or ipvlan networks",
+			Value:  0,
+			EnvVar: "UCLOUD_SECONDARY_IP_COUNT",
 		},
 		mcnflag.StringFlag{
-			Name:  "ucloud-security-group",
-			Usage: "UCloud security group",
-			Value: "docker-machine",
+			Name:   "ucloud-security-group",
+			Usage:  "UCloud security group",
+			Value:  "docker-machine",
+			EnvVar: "UCLOUD_SECURITY_GROUP",
+		},
+		mcnflag.StringSliceFlag{
+			Name:   "ucloud-security-group-rule",
+			Usage:  "Rule of the created security group in format of Protocol|Port|CIDR|Action|Priority, can be specified multiple times",
+			Value:  []string{},
+			EnvVar: "UCLOUD_SECURITY_GROUP_RULE",
+		},
+		mcnflag.StringSliceFlag{
+			Name:   "ucloud-open-port",
+			Usage:  "Port[/Protocol] to open in the created security group like 8080/tcp or 8000-8100/udp, can be specified multiple times",
+			Value:  []string{},
+			EnvVar: "UCLOUD_OPEN_PORT",
+		},
+		mcnflag.IntFlag{
+			Name:   "ucloud-security-group-id",
+			Usage:  "Id of an existing UCloud security group, it is used instead of --ucloud-security-group",
+			Value:  0,
+			EnvVar: "UCLOUD_SECURITY_GROUP_ID",
 		},
 	}
 }
@@ -141,9 +655,30 @@ func (d *Driver) DriverName() string {
 }
 
 func (d *Driver) GetSSHHostname() (string, error) {
+	if d.useTunnel() {
+		if _, err := d.sshTunnel(); err != nil {
+			return "", err
+		}
+		return "127.0.0.1", nil
+	}
+
 	return d.GetIP()
 }
 
+// GetSSHPort get the local port of the tunnel if SSH goes through the bastion
+// host or proxy command, the SSH port of uhost is used otherwise
+func (d *Driver) GetSSHPort() (int, error) {
+	if d.useTunnel() {
+		t, err := d.sshTunnel()
+		if err != nil {
+			return 0, err
+		}
+		return t.port(), nil
+	}
+
+	return d.BaseDriver.GetSSHPort()
+}
+
 func (d *Driver) GetSSHUsername() string {
 	if d.SSHUser == "" {
 		d.SSHUser = "root"
@@ -156,9 +691,13 @@ func (d *Driver) setDefaultConfig() {
 	d.Memory = defaultMemory
 	d.CPU = defaultCPU
 	d.ChargeType = defaultChargeType
+	d.ChargeDuration = defaultChargeDuration
 	d.DiskSpace = defaultDiskSpace
 	d.Region = defaultRegion
-	d.ImageId = defaultImageId
+	d.ImageName = defaultImageName
+	d.EIPChargeMode = defaultEIPChargeMode
+	d.EIPBandwidth = defaultEIPBandwidth
+	d.Arch = archX86
 }
 
 func (d *Driver) isSwarmMaster() bool {
@@ -167,43 +706,268 @@ func (d *Driver) isSwarmMaster() bool {
 
 func (d *Driver) SetConfigFromFlags(flags drivers.DriverOptions) error {
 	d.setDefaultConfig()
-	region, err := validateUCloudRegion(flags.String("ucloud-region"))
+
+	// the config of ucloud CLI is used if flags and env vars are absent
+	shared, err := loadSharedConfig(defaultSharedConfigDir())
 	if err != nil {
-		return err
+		log.Warnf("load ucloud shared config failed:%s", err)
+		shared = &sharedConfig{}
+	}
+
+	d.Region = flags.String("ucloud-region")
+	if d.Region == "" {
+		d.Region = shared.Region
+	}
+	if d.Region == "" {
+		d.Region = defaultRegion
+	}
+	if region, deprecated := canonicalRegion(d.Region); deprecated {
+		log.Warnf("region %s is deprecated, use %s instead", d.Region, region)
+		d.Region = region
+	}
+	// the region is validated by GetRegion API in PreCreateCheck, builtin
+	// region list is only used for warning here
+	if _, err := validateUCloudRegion(d.Region); err != nil {
+		log.Warnf("region %s is not in the builtin region list", d.Region)
 	}
-	d.Region = region
+	d.Zone = flags.String("ucloud-zone")
 
 	d.PublicKey = flags.String("ucloud-public-key")
+	if d.PublicKey == "" {
+		d.PublicKey = shared.PublicKey
+	}
 	if d.PublicKey == "" {
 		return fmt.Errorf("ucloud driver requires the --ucloud-public-key option")
 	}
 	log.Debugf("ucloud public key: %s", d.PublicKey)
 
 	d.PrivateKey = flags.String("ucloud-private-key")
+	if d.PrivateKey == "" {
+		d.PrivateKey = shared.PrivateKey
+	}
 	if d.PrivateKey == "" {
 		return fmt.Errorf("ucloud driver requires the --ucloud-private-key option")
 	}
-	log.Debugf("ucloud private key: %s", d.PrivateKey)
+	log.Debugf("ucloud private key: %s", mask(d.PrivateKey))
+
+	d.SecurityToken = flags.String("ucloud-security-token")
+	if expiry := flags.String("ucloud-security-token-expiry"); expiry != "" {
+		t, err := time.Parse(time.RFC3339, expiry)
+		if err != nil {
+			return fmt.Errorf("security token expiry %s is invalid:%w", expiry, err)
+		}
+		d.SecurityTokenExpiry = t
+	}
+
+	d.ProjectId = flags.String("ucloud-project-id")
+	if d.ProjectId == "" {
+		d.ProjectId = shared.ProjectId
+	}
+
+	d.APIEndpoint = flags.String("ucloud-api-endpoint")
+	if d.APIEndpoint != "" {
+		u, err := url.Parse(d.APIEndpoint)
+		if err != nil || u.Scheme == "" || u.Host == "" {
+			return fmt.Errorf("API endpoint %s is invalid", d.APIEndpoint)
+		}
+	}
 
 	image := flags.String("ucloud-imageid")
-	if len(image) == 0 {
-		image = defaultImageId
+	d.ImageName = flags.String("ucloud-image-name")
+	if image != "" && d.ImageName != "" {
+		return fmt.Errorf("--ucloud-imageid and --ucloud-image-name can not be used together")
+	}
+	if len(image) == 0 && d.ImageName == "" {
+		d.ImageName = defaultImageName
 	}
 	d.ImageId = image
 	d.CPU = flags.Int("ucloud-cpu-core")
 	d.Memory = flags.Int("ucloud-memory-size")
 	d.DiskSpace = flags.Int("ucloud-disk-space")
 	d.ChargeType = flags.String("ucloud-charge-type")
+	if err := validateChargeType(d.ChargeType); err != nil {
+		return fmt.Errorf("charge type %s is invalid:%w", d.ChargeType, err)
+	}
+	d.ChargeDuration = flags.Int("ucloud-charge-duration")
+	if d.ChargeDuration < 0 {
+		return fmt.Errorf("charge duration must not be negative")
+	}
+	d.AutoRenew = flags.Bool("ucloud-auto-renew")
+	d.CreateTimeout = flags.Int("ucloud-create-timeout")
+	d.RetryCount = flags.Int("ucloud-retry-count")
+	d.PollInterval = flags.Int("ucloud-poll-interval")
+	d.StopTimeout = flags.Int("ucloud-stop-timeout")
+	d.StateCacheTTL = flags.Int("ucloud-state-cache-ttl")
+	if d.CreateTimeout < 0 || d.RetryCount < 0 || d.PollInterval < 0 || d.StopTimeout < 0 || d.StateCacheTTL < 0 {
+		return fmt.Errorf("create timeout, stop timeout, retry count, poll interval and state cache ttl must not be negative")
+	}
+	d.SSHRetries = flags.Int("ucloud-ssh-retries")
+	d.SSHRetryInterval = flags.Int("ucloud-ssh-retry-interval")
+	d.VerifyHostKey = flags.Bool("ucloud-verify-host-key")
+	if d.SSHRetries < 0 || d.SSHRetryInterval < 0 {
+		return fmt.Errorf("SSH retries and SSH retry interval must not be negative")
+	}
+	d.CouponId = flags.String("ucloud-coupon-id")
+	d.MaxPrice = flags.Int("ucloud-max-price")
+	if d.MaxPrice < 0 {
+		return fmt.Errorf("max price must not be negative")
+	}
+	d.MachineType = strings.ToUpper(flags.String("ucloud-machine-type"))
+	d.Arch = strings.ToLower(flags.String("ucloud-arch"))
+	if err := validateArch(d.Arch); err != nil {
+		return fmt.Errorf("architecture %s is invalid:%w", d.Arch, err)
+	}
+	if d.Arch == archARM && d.MachineType == "" {
+		d.MachineType = defaultARMMachineType
+	}
+	d.Hotplug = flags.Bool("ucloud-hotplug")
+	d.NetCapability = flags.String("ucloud-net-capability")
+	if d.NetCapability != "" {
+		if err := validateNetCapability(d.NetCapability); err != nil {
+			return fmt.Errorf("net capability %s is invalid:%w", d.NetCapability, err)
+		}
+	}
+
+	d.BootDiskType = strings.ToUpper(flags.String("ucloud-boot-disk-type"))
+	if d.BootDiskType != "" {
+		if err := validateDiskType(d.BootDiskType); err != nil {
+			return fmt.Errorf("boot disk type %s is invalid:%w", d.BootDiskType, err)
+		}
+	}
+	d.DataDiskSize = flags.Int("ucloud-data-disk-size")
+	d.DataDiskType = strings.ToUpper(flags.String("ucloud-data-disk-type"))
+	if d.DataDiskType != "" {
+		if err := validateDiskType(d.DataDiskType); err != nil {
+			return fmt.Errorf("data disk type %s is invalid:%w", d.DataDiskType, err)
+		}
+	}
+	d.UDiskIds = flags.StringSlice("ucloud-udisk-id")
+	d.KeepDataDisks = flags.Bool("ucloud-keep-data-disks")
+	if d.KeepDataDisks && d.DataDiskSize > 0 && !strings.HasPrefix(d.DataDiskType, "CLOUD_") {
+		return fmt.Errorf("only the cloud data disk can be kept, please set --ucloud-data-disk-type to CLOUD_SSD or CLOUD_RSSD")
+	}
 
 	d.PrivateIPOnly = flags.Bool("ucloud-private-address-only")
+	d.NATGWId = flags.String("ucloud-natgw-id")
+	d.CreateNATGW = flags.Bool("ucloud-create-natgw")
+	if (d.NATGWId != "" || d.CreateNATGW) && !d.PrivateIPOnly {
+		return fmt.Errorf("NAT gateway can only be used with --ucloud-private-address-only")
+	}
+	if d.NATGWId != "" && d.CreateNATGW {
+		return fmt.Errorf("--ucloud-natgw-id and --ucloud-create-natgw can not be used together")
+	}
+	d.BastionHost = flags.String("ucloud-bastion-host")
+	d.BastionUser = flags.String("ucloud-bastion-user")
+	d.BastionKey = flags.String("ucloud-bastion-key")
+	if d.BastionHost != "" && d.BastionKey == "" {
+		return fmt.Errorf("bastion key must be set with the bastion host")
+	}
+	d.SSHProxyCommand = flags.String("ucloud-ssh-proxy-command")
+	if d.BastionHost != "" && d.SSHProxyCommand != "" {
+		return fmt.Errorf("bastion host and SSH proxy command can not be used together")
+	}
+	d.StaticPrivateIP = flags.String("ucloud-private-ip")
+	if d.StaticPrivateIP != "" && net.ParseIP(d.StaticPrivateIP) == nil {
+		return fmt.Errorf("private IP %s is invalid", d.StaticPrivateIP)
+	}
+	d.IPv6 = flags.Bool("ucloud-ipv6")
+	d.EIPId = flags.String("ucloud-eip-id")
+	d.ExistingEIP = d.EIPId != ""
+	d.EIPChargeMode = flags.String("ucloud-eip-charge-mode")
+	if _, err := eipPayMode(d.EIPChargeMode); err != nil {
+		return fmt.Errorf("EIP charge mode %s is invalid:%w", d.EIPChargeMode, err)
+	}
+	d.EIPOperator = flags.String("ucloud-eip-operator")
+	if d.EIPOperator != "" {
+		if err := validateEIPOperator(d.EIPOperator); err != nil {
+			return fmt.Errorf("EIP operator %s is invalid:%w", d.EIPOperator, err)
+		}
+	}
+	d.EIPBandwidth = flags.Int("ucloud-eip-bandwidth")
+	if d.EIPBandwidth <= 0 {
+		return fmt.Errorf("EIP bandwidth must be positive")
+	}
+	d.ShareBandwidthId = flags.String("ucloud-share-bandwidth-id")
 	d.SecurityGroupName = flags.String("ucloud-security-group")
+	d.SecurityGroupId = flags.Int("ucloud-security-group-id")
+	d.SecurityGroupRules = flags.StringSlice("ucloud-security-group-rule")
+	for _, rule := range d.SecurityGroupRules {
+		if err := validateSecurityGroupRule(rule); err != nil {
+			return fmt.Errorf("security group rule %s is invalid:%w", rule, err)
+		}
+	}
+	d.OpenPorts = flags.StringSlice("ucloud-open-port")
+	for _, port := range d.OpenPorts {
+		if _, err := openPortRule(port); err != nil {
+			return fmt.Errorf("open port %s is invalid:%w", port, err)
+		}
+	}
+
+	d.VPCId = flags.String("ucloud-vpc-id")
+	d.SubnetId = flags.String("ucloud-subnet-id")
+	if d.SubnetId != "" && d.VPCId == "" {
+		return fmt.Errorf("ucloud driver requires the --ucloud-vpc-id option when --ucloud-subnet-id is set")
+	}
+	d.SecondaryIPCount = flags.Int("ucloud-secondary-ip-count")
+	if d.SecondaryIPCount < 0 {
+		return fmt.Errorf("secondary IP count must not be negative")
+	}
+	d.SecondarySubnetId = flags.String("ucloud-secondary-subnet-id")
+	if d.SecondarySubnetId != "" && d.VPCId == "" {
+		return fmt.Errorf("ucloud driver requires the --ucloud-vpc-id option when --ucloud-secondary-subnet-id is set")
+	}
 
 	d.SSHUser = strings.ToLower(flags.String("ucloud-ssh-user"))
 	if d.SSHUser == "" {
 		d.SSHUser = "root"
 	}
+	if err := validateSSHUser(d.SSHUser); err != nil {
+		return fmt.Errorf("SSH user %s is invalid:%w", d.SSHUser, err)
+	}
 	d.Password = flags.String("ucloud-user-password")
 	d.SSHPort = flags.Int("ucloud-ssh-port")
+	if !validPort(d.SSHPort) {
+		return fmt.Errorf("SSH port %d is invalid", d.SSHPort)
+	}
+	d.SSHPrivateKeyPath = flags.String("ucloud-ssh-key-path")
+	d.DockerPort = flags.Int("ucloud-docker-port")
+	if !validPort(d.DockerPort) {
+		return fmt.Errorf("Docker port %d is invalid", d.DockerPort)
+	}
+	d.DockerInstallURL = dockerInstallURL(flags.String("ucloud-docker-install-url"), d.Region)
+	if d.DockerInstallURL != "" && !strings.HasPrefix(d.DockerInstallURL, "https://") {
+		return fmt.Errorf("--ucloud-docker-install-url must be an HTTPS URL, got:%s", d.DockerInstallURL)
+	}
+	d.UserDataFile = flags.String("ucloud-userdata")
+	d.ConfigureSSHPort = flags.Bool("ucloud-configure-ssh-port")
+	d.DisablePasswordLogin = flags.Bool("ucloud-disable-password-login")
+	if flags.Bool("ucloud-keypair-login") {
+		log.Warn("--ucloud-keypair-login is deprecated, the public key is installed at boot by default")
+	}
+	d.UMonAgentURL = flags.String("ucloud-umon-agent-url")
+	if d.UMonAgentURL != "" && !strings.HasPrefix(d.UMonAgentURL, "https://") {
+		return fmt.Errorf("--ucloud-umon-agent-url must be an HTTPS URL, got:%s", d.UMonAgentURL)
+	}
+	d.AlarmTemplateId = flags.String("ucloud-alarm-template-id")
+	if (d.ConfigureSSHPort || d.UMonAgentURL != "") && d.UserDataFile != "" {
+		return fmt.Errorf("--ucloud-configure-ssh-port and --ucloud-umon-agent-url can not be used with --ucloud-userdata, please configure them in the user data")
+	}
+	// the public key is installed by the cloud-init user data, it is
+	// uploaded with password if the user data is customized
+	d.KeyPairLogin = !flags.Bool("ucloud-upload-keypair") && d.UserDataFile == ""
+	d.ImportKeyPair = flags.Bool("ucloud-import-keypair")
+	if !d.KeyPairLogin {
+		log.Info("The public key will be uploaded with password after the UHost is running")
+	}
+	d.ULBId = flags.String("ucloud-ulb-id")
+	d.ULBBackendPort = flags.Int("ucloud-ulb-backend-port")
+	if d.ULBId != "" && !validPort(d.ULBBackendPort) {
+		return fmt.Errorf("ULB backend port %d is invalid", d.ULBBackendPort)
+	}
+	d.Tag = flags.String("ucloud-tag")
+	d.Remark = flags.String("ucloud-remark")
+	d.DeleteProtection = flags.Bool("ucloud-delete-protection")
+	d.RemoveAllResources = flags.Bool("ucloud-remove-all-resources")
 
 	d.SwarmMaster = flags.Bool("swarm-master")
 	d.SwarmHost = flags.String("swarm-host")
@@ -212,7 +976,7 @@ func (d *Driver) SetConfigFromFlags(flags drivers.DriverOptions) error {
 	if d.isSwarmMaster() {
 		u, err := url.Parse(d.SwarmHost)
 		if err != nil {
-			return fmt.Errorf("error parsing swarm host: %s", err)
+			return fmt.Errorf("error parsing swarm host: %w", err)
 		}
 
 		parts := strings.Split(u.Host, ":")
@@ -227,59 +991,480 @@ func (d *Driver) SetConfigFromFlags(flags drivers.DriverOptions) error {
 	return nil
 }
 
-func (d *Driver) PreCreateCheck() error {
-	if d.CPU < 1 || d.CPU > 16 {
-		return fmt.Errorf("CPU cores must be in set of (1,2,4,8,16)")
+// checkRegion validate region and zone with the GetRegion API
+func (d *Driver) checkRegion(ctx context.Context) error {
+	regions, err := d.getRegions(ctx)
+	if err != nil {
+		// fallback to the builtin region list if GetRegion is not available
+		log.Warnf("get regions failed, use the builtin region list instead:%s", err)
+		if _, err := validateUCloudRegion(d.Region); err != nil {
+			return fmt.Errorf("region %s is invalid:%w", d.Region, err)
+		}
+		return nil
 	}
-	if d.Memory < 1024 || d.Memory > 65536 {
-		return fmt.Errorf("Memory must be in range of [2048, 65536) with step of 2048MB, you can set 1024 in beijing-BGP-C")
+
+	zones, ok := regions[d.Region]
+	if !ok {
+		return fmt.Errorf("region %s is invalid:%w", d.Region, errInvalidRegion)
 	}
-	if d.DiskSpace > 1000 {
-		return fmt.Errorf("Disk space must in range of [0, 1000) with step of 10GB")
+
+	if d.Zone != "" {
+		if err := validateUCloudZone(d.Zone, zones); err != nil {
+			return fmt.Errorf("zone %s is not in region %s, available zones: %s", d.Zone, d.Region, strings.Join(zones, ","))
+		}
+	}
+
+	return nil
+}
+
+// checkImage check whether the image is available and can be logged in with
+// SSH password, which is needed to upload the keypair
+func (d *Driver) checkImage(ctx context.Context) error {
+	image, err := d.getImage(ctx)
+	if err != nil {
+		return newError(ErrInvalidImage, "get image failed:%s%s", err, d.suggestImages(ctx, d.ImageId))
+	}
+
+	if image.State != "Available" {
+		return newError(ErrInvalidImage, "image %s is not available, state:%s%s", d.ImageId, image.State, d.suggestImages(ctx, image.OsName))
+	}
+
+	if image.OsType != "Linux" {
+		return newError(ErrInvalidImage, "image %s is not supported, os type %s can not be logged in with SSH%s", d.ImageId, image.OsType, d.suggestImages(ctx, image.OsName))
+	}
+
+	if arch := imageArch(image.OsName, image.ImageName); arch != d.Arch {
+		return newError(ErrInvalidImage, "image %s is built for %s, it can not run on the %s uhost%s", d.ImageId, arch, d.Arch, d.suggestImages(ctx, image.OsName))
+	}
+
+	d.OsName = image.OsName
+
+	return nil
+}
+
+// resolveImage set ImageId to the newest base image matching ImageName
+func (d *Driver) resolveImage(ctx context.Context) error {
+	images, err := d.listImages(ctx, d.Region)
+	if err != nil {
+		return fmt.Errorf("list images failed:%w", err)
+	}
+
+	// only the images of the uhost architecture can be used
+	var matched []Image
+	for _, image := range images {
+		if image.Arch == d.Arch {
+			matched = append(matched, image)
+		}
+	}
+
+	image := newestImage(d.ImageName, matched)
+	if image == nil {
+		return newError(ErrInvalidImage, "no image matches %s in region %s%s", d.ImageName, d.Region, d.suggestImages(ctx, d.ImageName))
+	}
+	log.Infof("Using image %s(%s) for %s", image.Id, image.OsName, d.ImageName)
+	d.ImageId = image.Id
+
+	return nil
+}
+
+// suggestImages get the hint of the available images closest to target
+func (d *Driver) suggestImages(ctx context.Context, target string) string {
+	images, err := d.listImages(ctx, d.Region)
+	if err != nil {
+		log.Debugf("list images failed:%s", err)
+		return ""
+	}
+
+	var hint []string
+	for _, i := range closestImages(target, images, 5) {
+		hint = append(hint, fmt.Sprintf("%s(%s)", i.Id, i.OsName))
+	}
+	if len(hint) == 0 {
+		return ""
+	}
+
+	return ", available images: " + strings.Join(hint, ", ")
+}
+
+// checkQuota check whether the remaining quota is enough for the uhost and EIP
+func (d *Driver) checkQuota(ctx context.Context) error {
+	needEIP := !d.PrivateIPOnly && !d.ExistingEIP
+	resourceTypes := []string{quotaUHostCPU, quotaUHostMemory}
+	if needEIP {
+		resourceTypes = append(resourceTypes, quotaEIP)
+	}
+
+	quotas, err := d.getQuotas(ctx, resourceTypes)
+	if err != nil {
+		log.Warnf("get quota failed, skip the quota check:%s", err)
+		return nil
+	}
+
+	if available, ok := quotas[quotaUHostCPU]; ok && available < d.CPU {
+		return newError(ErrQuotaExceeded, "CPU quota exceeded in region %s, requested %d cores, available %d cores", d.Region, d.CPU, available)
+	}
+	if available, ok := quotas[quotaUHostMemory]; ok && available < d.Memory {
+		return newError(ErrQuotaExceeded, "Memory quota exceeded in region %s, requested %dMB, available %dMB", d.Region, d.Memory, available)
+	}
+	if available, ok := quotas[quotaEIP]; ok && needEIP && available < 1 {
+		return newError(ErrQuotaExceeded, "EIP quota exceeded in region %s", d.Region)
+	}
+
+	return nil
+}
+
+func (d *Driver) PreCreateCheck() error {
+	ctx := context.Background()
+	if d.SecurityToken != "" && !d.SecurityTokenExpiry.IsZero() && time.Now().After(d.SecurityTokenExpiry) {
+		return newError(ErrAuthFailed, "security token is expired at %s", d.SecurityTokenExpiry.Format(time.RFC3339))
+	}
+	if d.CPU < 1 || d.CPU > 16 {
+		return fmt.Errorf("CPU cores must be in set of (1,2,4,8,16)")
+	}
+	if d.Memory < 1024 || d.Memory > 65536 {
+		return fmt.Errorf("Memory must be in range of [1024, 65536] with step of 2048MB, 1024MB is only available in beijing-BGP-C")
+	}
+	if d.DiskSpace > 1000 {
+		return fmt.Errorf("Disk space must in range of [0, 1000) with step of 10GB")
+	}
+	if d.DataDiskSize < 0 || d.DataDiskSize > 8000 {
+		return fmt.Errorf("Data disk size must in range of [0, 8000] with step of 10GB")
+	}
+
+	if err := d.checkRegion(ctx); err != nil {
+		return err
+	}
+
+	// the create call fails with an opaque error if the zone is out of stock
+	if err := d.selectZone(ctx); err != nil {
+		if errors.Is(err, ErrNoStock) {
+			return err
+		}
+		log.Warnf("Unable to select zone by stock, it is chosen by UCloud: %s", err)
+	}
+
+	if d.MachineType != "" {
+		machineTypes, err := d.getMachineTypes(ctx)
+		if err != nil {
+			return fmt.Errorf("get machine types failed:%w", err)
+		}
+		if err := validateMachineType(d.MachineType, machineTypes); err != nil {
+			return newError(ErrInvalidMachineType, "machine type %s is not available in the zone, available machine types: %s", d.MachineType, strings.Join(machineTypes, ","))
+		}
+	}
+
+	if d.ImageName != "" {
+		if err := d.resolveImage(ctx); err != nil {
+			return err
+		}
+	}
+
+	if err := d.checkImage(ctx); err != nil {
+		return err
+	}
+
+	if err := d.checkQuota(ctx); err != nil {
+		return err
+	}
+
+	// the price can only be guarded if it is estimated
+	price, err := d.estimatePrice(ctx)
+	if err != nil {
+		if d.MaxPrice > 0 {
+			return fmt.Errorf("estimate price failed:%w", err)
+		}
+		log.Warnf("Unable to estimate the price: %s", err)
+	} else {
+		log.Infof("The estimated price is %.2f CNY per hour, %.2f CNY per month", price/hoursPerMonth, price)
+		if d.MaxPrice > 0 && price > float64(d.MaxPrice) {
+			return fmt.Errorf("the estimated price %.2f CNY per month exceeds the max price %d CNY", price, d.MaxPrice)
+		}
+	}
+
+	// a previous interrupted run may leave an uhost with the same name
+	uhostId, err := d.findUHostByName(ctx)
+	if err != nil {
+		return fmt.Errorf("find existing UHost failed:%w", err)
+	}
+	if uhostId != "" {
+		return newError(ErrUHostExists, "UHost %s named %s already exists, please remove it or use another machine name", uhostId, d.MachineName)
 	}
 	return nil
 }
 
-func (d *Driver) Create() error {
+func (d *Driver) Create() (err error) {
+	ctx := context.Background()
 	log.Infof("Create UHost instance...")
 
 	if d.Password == "" {
-		d.Password = generateRandomPassword(16)
-		log.Infof("password is not set, we use the random password instead, password:%s", d.Password)
+		if d.Password, err = generateRandomPassword(16); err != nil {
+			return err
+		}
+		log.Infof("password is not set, we use the random password instead, it is saved in the machine config")
 	}
 
+	steps := newProgress(createSteps)
+
 	// create keypair
-	log.Infof("Creating key pair for instances...")
+	steps.next()
 	if err := d.createKeyPair(); err != nil {
-		return fmt.Errorf("unable to create key pair: %s", err)
+		return fmt.Errorf("unable to create key pair: %w", err)
+	}
+
+	// release the resources created so far if any step fails
+	defer func() {
+		if err != nil {
+			d.rollback(ctx)
+		}
+	}()
+
+	if d.ImportKeyPair {
+		if err := d.importKeyPair(ctx); err != nil {
+			return fmt.Errorf("import key pair failed:%w", err)
+		}
 	}
+	steps.done(resource("ssh key", d.GetSSHKeyPath()), resource("key pair", d.KeyPairId))
 
-	// create uhost instance
-	log.Infof("Creating uhost instance...")
-	if err := d.createUHost(); err != nil {
-		return fmt.Errorf("create UHost failed:%s", err)
+	// create uhost instance, the VPC and subnet are created first if there
+	// is no usable one, and they are deleted by rollback
+	steps.next()
+	if err := d.api().ensureVPC(ctx); err != nil {
+		return fmt.Errorf("ensure VPC failed:%w", err)
+	}
+	if err := d.api().createUHost(ctx); err != nil {
+		return fmt.Errorf("create UHost failed:%w", err)
 	}
+	steps.done(resource("VPC", d.VPCId), resource("subnet", d.SubnetId), resource("uhost", d.UhostID))
 
-	// waiting for creating successful
-	if err := mcnutils.WaitForSpecific(drivers.MachineInState(d, state.Running), 120, 3*time.Second); err != nil {
-		return fmt.Errorf("wait for machine running failed: %s", err)
+	// allocate the EIP and security group while the uhost is booting, they
+	// are bound after the uhost is running
+	type prepareResult struct {
+		unet preparedUNet
+		err  error
 	}
+	prepared := make(chan prepareResult, 1)
+	go func() {
+		p, err := d.api().prepareUNet(ctx)
+		prepared <- prepareResult{p, err}
+	}()
+
+	// waiting for creating successful, GetState changes the driver so the
+	// prepared resources are only set after it
+	steps.next()
+	waitErr := d.waitFor(drivers.MachineInState(d, state.Running), d.createTimeout())
+	result := <-prepared
+	d.setPreparedUNet(result.unet)
+	prepareErr := result.err
+	if waitErr != nil {
+		return fmt.Errorf("wait for machine running failed: %w", waitErr)
+	}
+	if prepareErr != nil {
+		return fmt.Errorf("prepare networks failed:%w", prepareErr)
+	}
+
+	// the zone is chosen by UCloud if it is not set
+	if _, err := d.getZone(ctx); err != nil {
+		log.Warnf("Unable to record the zone of UHost: %s", err)
+	}
+	steps.done(resource("zone", d.Zone))
+
+	// attach the existing udisks
+	steps.next()
+	if err := d.attachUDisks(ctx); err != nil {
+		return fmt.Errorf("attach udisks failed:%w", err)
+	}
+
+	if err := d.recordDiskIds(ctx); err != nil {
+		log.Warnf("Unable to record the disks of UHost: %s", err)
+	}
+	steps.done(resource("disks", strings.Join(d.DiskIds, ",")), resource("udisks", strings.Join(d.UDiskIds, ",")))
 
 	// create networks, like private ip, eip, and security group
-	log.Infof("Creating networks...")
-	//TODO: user the exist eip and security group to configure network
-	if err := d.createUNet(); err != nil {
-		return fmt.Errorf("create networks failed:%s", err)
+	steps.next()
+	if err := d.api().createUNet(ctx); err != nil {
+		return fmt.Errorf("create networks failed:%w", err)
+	}
+
+	// attach the network interface in the secondary subnet
+	if err := d.attachSecondaryNIC(ctx); err != nil {
+		return fmt.Errorf("attach secondary network interface failed:%w", err)
+	}
+
+	if err := d.allocateSecondaryIPs(ctx); err != nil {
+		return fmt.Errorf("allocate secondary IPs failed:%w", err)
+	}
+
+	// the private only uhost access internet through the NAT gateway
+	if err := d.attachNATGW(ctx); err != nil {
+		return fmt.Errorf("attach NAT gateway failed:%w", err)
+	}
+
+	// add uhost to the existing ULB
+	if err := d.registerULB(ctx); err != nil {
+		return fmt.Errorf("register ULB failed:%w", err)
+	}
+
+	// attach uhost to the existing alarm template
+	if err := d.bindAlarmTemplate(ctx); err != nil {
+		return fmt.Errorf("bind alarm template failed:%w", err)
+	}
+	securityGroup := ""
+	if d.SecurityGroupId != 0 {
+		securityGroup = strconv.Itoa(d.SecurityGroupId)
+	}
+	steps.done(resource("EIP", d.EIPId), resource("IP", d.IPAddress), resource("private IP", d.PrivateIPAddress),
+		resource("security group", securityGroup), resource("network interface", d.NetworkInterfaceId),
+		resource("NAT gateway", d.NATGWId))
+
+	// upload keypair, it is installed at boot in key pair login mode
+	if !d.KeyPairLogin {
+		steps.next()
+		if err := d.uploadKeyPair(); err != nil {
+			return fmt.Errorf("upload keypair failed:%w", err)
+		}
+		steps.done()
+	} else {
+		steps.skip("the key is installed at boot")
 	}
 
-	// upload keypair
-	if err := d.uploadKeyPair(); err != nil {
-		return fmt.Errorf("upload keypair failed:%s", err)
+	// install Docker from the mirror, the provisioner skips the
+	// installation if Docker is installed, it SSH the uhost with the
+	// machine key so it must run after the key is uploaded
+	if d.DockerInstallURL != "" {
+		steps.next()
+		if err := d.installDocker(); err != nil {
+			return fmt.Errorf("install Docker failed:%w", err)
+		}
+		steps.done()
+	} else {
+		steps.skip("Docker is installed by the provisioner")
 	}
 
 	return nil
 }
 
+// retries get the max attempts of API requests, the machines created by
+// older driver have no retry count
+func (d *Driver) retries() int {
+	if d.RetryCount > 0 {
+		return d.RetryCount
+	}
+	return defaultRetries
+}
+
+// sshRetries get the max attempts of the bootstrap SSH commands
+func (d *Driver) sshRetries() int {
+	if d.SSHRetries > 0 {
+		return d.SSHRetries
+	}
+	return defaultSSHRetries
+}
+
+// sshRetryInterval get the delay before the first retry of the bootstrap SSH
+// commands
+func (d *Driver) sshRetryInterval() time.Duration {
+	if d.SSHRetryInterval > 0 {
+		return time.Duration(d.SSHRetryInterval) * time.Second
+	}
+	return defaultSSHRetryDelay * time.Second
+}
+
+// createTimeout get the timeout of waiting for the uhost running
+func (d *Driver) createTimeout() time.Duration {
+	if d.CreateTimeout > 0 {
+		return time.Duration(d.CreateTimeout) * time.Second
+	}
+	return defaultCreateTimeout * time.Second
+}
+
+// pollInterval get the interval of polling the states
+func (d *Driver) pollInterval() time.Duration {
+	if d.PollInterval > 0 {
+		return time.Duration(d.PollInterval) * time.Second
+	}
+	return defaultPollInterval * time.Second
+}
+
+// waitAttempts get the attempts of polling in the timeout
+func (d *Driver) waitAttempts(timeout time.Duration) int {
+	if attempts := int(timeout / d.pollInterval()); attempts > 0 {
+		return attempts
+	}
+	return 1
+}
+
+// waitFor poll f in every poll interval until it returns true or timeout
+func (d *Driver) waitFor(f func() bool, timeout time.Duration) error {
+	return mcnutils.WaitForSpecific(f, d.waitAttempts(timeout), d.pollInterval())
+}
+
+// rollback release the uhost, EIP, security group and VPC created by Create,
+// the ids of the resources which can not be released are reported
+func (d *Driver) rollback(ctx context.Context) {
+	log.Warnf("Create failed, releasing the created resources...")
+	var leaked []string
+
+	if err := d.deregisterULB(ctx); err != nil {
+		log.Warnf("Unable to deregister from the ULB: %s", err)
+		leaked = append(leaked, "backends "+strings.Join(d.ULBBackendIds, ",")+" of ULB "+d.ULBId)
+	}
+
+	if d.UhostID != "" {
+		if err := d.detachUDisks(ctx); err != nil {
+			log.Warnf("Unable to detach the UDisks: %s", err)
+		}
+		if err := d.deleteSecondaryIPs(ctx); err != nil {
+			log.Warnf("Unable to delete the secondary IPs: %s", err)
+		}
+		if err := d.api().terminateUHost(ctx); err != nil {
+			log.Warnf("Unable to terminate the UHost instance: %s", err)
+			leaked = append(leaked, "uhost "+d.UhostID)
+		} else if err := d.waitFor(d.uhostTerminatedFunc(ctx), 3*time.Minute); err != nil {
+			log.Warnf("wait for UHost terminated failed: %s", err)
+		}
+	}
+
+	if d.EIPId != "" && !d.ExistingEIP {
+		if err := d.releaseEIP(ctx); err != nil {
+			log.Warnf("Unable to release the EIP: %s", err)
+			leaked = append(leaked, "EIP "+d.EIPId)
+		}
+	}
+
+	if err := d.deleteSecondaryNIC(ctx); err != nil {
+		log.Warnf("Unable to delete the network interface: %s", err)
+		leaked = append(leaked, "network interface "+d.NetworkInterfaceId)
+	}
+
+	if d.SecurityGroupCreated && d.SecurityGroupId == 0 {
+		leaked = append(leaked, "security group "+d.SecurityGroupName)
+	} else if d.SecurityGroupCreated {
+		if err := d.deleteSecurityGroup(ctx, d.SecurityGroupId); err != nil {
+			log.Warnf("Unable to delete the security group: %s", err)
+			leaked = append(leaked, fmt.Sprintf("security group %d", d.SecurityGroupId))
+		}
+	}
+
+	if err := d.detachNATGW(ctx); err != nil {
+		log.Warnf("Unable to release the NAT gateway: %s", err)
+		leaked = append(leaked, "NAT gateway "+d.NATGWId)
+	}
+
+	if err := d.deleteVPC(ctx); err != nil {
+		log.Warnf("Unable to delete the VPC: %s", err)
+		leaked = append(leaked, "VPC "+d.VPCId)
+	}
+
+	if err := d.deleteKeyPair(ctx); err != nil {
+		log.Warnf("Unable to delete the key pair: %s", err)
+		leaked = append(leaked, "key pair "+d.KeyPairId)
+	}
+
+	if len(leaked) > 0 {
+		log.Errorf("The resources are not released, please remove them manually: %s", strings.Join(leaked, ", "))
+	}
+}
+
 func (d *Driver) GetURL() (string, error) {
 	ip, err := d.GetIP()
 	if err != nil {
@@ -289,10 +1474,26 @@ func (d *Driver) GetURL() (string, error) {
 		return "", nil
 	}
 
-	return fmt.Sprintf("tcp://%s:2376", ip), nil
+	return fmt.Sprintf("tcp://%s:%d", ip, d.dockerPort()), nil
+}
+
+// dockerPort get the port of Docker daemon, the machines created by older
+// driver have no Docker port
+func (d *Driver) dockerPort() int {
+	if d.DockerPort > 0 {
+		return d.DockerPort
+	}
+	return defaultDockerPort
 }
 
 func (d *Driver) GetIP() (string, error) {
+	// the cached address may be lost, look it up from the API
+	if (!d.PrivateIPOnly && d.IPAddress == "") || (d.PrivateIPOnly && d.PrivateIPAddress == "") {
+		if err := d.refreshIPAddress(context.Background()); err != nil {
+			return "", fmt.Errorf("refresh IP address failed:%w", err)
+		}
+	}
+
 	if !d.PrivateIPOnly && d.IPAddress == "" {
 		return "", fmt.Errorf("IP address is not set")
 	}
@@ -315,41 +1516,84 @@ func (d *Driver) GetIP() (string, error) {
 	return d.IPAddress, nil
 }
 
+// GetPrivateIPs get the private addresses of the primary and the secondary
+// network interface of the machine, followed by the secondary private IPs
+func (d *Driver) GetPrivateIPs() []string {
+	var ips []string
+	for _, ip := range []string{d.PrivateIPAddress, d.SecondaryIPAddress} {
+		if ip != "" {
+			ips = append(ips, ip)
+		}
+	}
+
+	return append(ips, d.SecondaryIPs...)
+}
+
+// uhostStates map the states of uhost to the machine states
+var uhostStates = map[string]state.State{
+	"Initializing":  state.Starting,
+	"Starting":      state.Starting,
+	"Rebooting":     state.Starting,
+	"Reinstalling":  state.Starting,
+	"Resizing":      state.Starting,
+	"Running":       state.Running,
+	"Migrating":     state.Running, // the guest keeps running in hot migration
+	"Stopping":      state.Stopping,
+	"Stopped":       state.Stopped,
+	"Install Fail":  state.Error,
+	"ReinstallFail": state.Error,
+	"Resize Fail":   state.Error,
+}
+
+// stateClock get the current time for the state cache, it is replaced in the
+// tests
+var stateClock = time.Now
+
 func (d *Driver) GetState() (state.State, error) {
+	ctx := context.Background()
 	log.Debugf("Get Machine State")
 	if d.UhostID == "" || d.Region == "" {
 		return state.None, fmt.Errorf("region or uhost is empty")
 	}
 
-	details, err := d.getHostDescription()
+	// libmachine polls the state frequently, use the cached one in the ttl to
+	// avoid the API throttling
+	ttl := time.Duration(d.StateCacheTTL) * time.Second
+	if !d.cachedStateAt.IsZero() && stateClock().Sub(d.cachedStateAt) < ttl {
+		return d.cachedState, nil
+	}
+
+	details, err := d.api().getHostDescription(ctx)
 	if err != nil {
+		d.invalidateState()
 		return state.None, err
 	}
 
 	var st state.State
 	if details != nil && details.state != "" {
-		switch details.state {
-		case "Initializing", "Starting", "Rebooting":
-			st = state.Starting
-		case "Running":
-			st = state.Running
-		case "Stopped":
-			st = state.Stopped
-		case "Stopping":
-			st = state.Stopping
-		case "Install Fail":
+		var ok bool
+		if st, ok = uhostStates[details.state]; !ok {
+			// state.None means the machine does not exist for docker-machine
+			log.Warnf("Unknown state %q of UHost %s", details.state, d.UhostID)
 			st = state.Error
-		default:
-			st = state.None
 		}
 	}
 
+	d.cachedState, d.cachedStateAt = st, stateClock()
 	return st, nil
 }
 
+// invalidateState drop the cached state, it must be called after the state of
+// uhost is changed
+func (d *Driver) invalidateState() {
+	d.cachedState, d.cachedStateAt = state.None, time.Time{}
+}
+
 func (d *Driver) Start() error {
+	ctx := context.Background()
 	log.Info("Start UHost...")
-	if err := d.startUHost(); err != nil {
+	d.invalidateState()
+	if err := d.api().startUHost(ctx); err != nil {
 		return fmt.Errorf("Cannot start Machine:%s, with UHost: %s.", d.MachineName, d.UhostID)
 	}
 
@@ -357,42 +1601,467 @@ func (d *Driver) Start() error {
 }
 
 func (d *Driver) Stop() error {
+	ctx := context.Background()
 	log.Info("Stop UHost...")
 	if len(d.UhostID) == 0 {
 		return fmt.Errorf("UHost is not exist for Machine: %s", d.MachineName)
 	}
 
-	if err := d.stopUHost(); err != nil {
-		return fmt.Errorf("Cannot start Machine:%s, with UHost: %s.", d.MachineName, d.UhostID)
+	d.invalidateState()
+	if err := d.api().stopUHost(ctx); err != nil {
+		return fmt.Errorf("Cannot stop Machine:%s, with UHost: %s.", d.MachineName, d.UhostID)
+	}
+
+	// power off the uhost if it ignores the shutdown in stop timeout
+	if err := d.waitFor(drivers.MachineInState(d, state.Stopped), d.stopTimeout()); err == nil {
+		log.Infof("UHost %s is stopped gracefully", d.UhostID)
+		return nil
 	}
 
+	log.Warnf("UHost %s is not stopped in %s, powering it off...", d.UhostID, d.stopTimeout())
+	if err := d.Kill(); err != nil {
+		return err
+	}
+	log.Infof("UHost %s is powered off", d.UhostID)
+
 	return nil
 }
 
+// stopTimeout get the timeout of waiting for the graceful shutdown
+func (d *Driver) stopTimeout() time.Duration {
+	if d.StopTimeout > 0 {
+		return time.Duration(d.StopTimeout) * time.Second
+	}
+	return defaultStopTimeout * time.Second
+}
+
 func (d *Driver) Remove() error {
+	ctx := context.Background()
 	log.Debug("Removing...")
-	if err := d.terminateUHost(); err != nil {
-		return fmt.Errorf("Unable to terminate the UHost instance: %s", err)
+	if d.DeleteProtection && os.Getenv(forceRemoveEnv) == "" {
+		// docker-machine rm -f deletes the machine directory even if Remove fails
+		resources := "UHost " + d.UhostID
+		if d.EIPId != "" {
+			resources += " and EIP " + d.EIPId
+		}
+		log.Warnf("Machine %s is protected from deletion, the resources %s are kept running and billed. With docker-machine rm -f the machine config and its SSH key are deleted anyway, release them in the UCloud console then.", d.MachineName, resources)
+		return fmt.Errorf("machine %s is protected from deletion, set %s=1 to remove %s", d.MachineName, forceRemoveEnv, resources)
+	}
+
+	if err := d.deregisterULB(ctx); err != nil {
+		log.Warnf("Unable to deregister from the ULB: %s", err)
+	}
+
+	if err := d.detachUDisks(ctx); err != nil {
+		return fmt.Errorf("Unable to detach the UDisks: %w", err)
+	}
+
+	if d.KeepDataDisks {
+		if err := d.keepDataDisks(ctx); err != nil {
+			return fmt.Errorf("Unable to keep the data disks: %w", err)
+		}
+	}
+
+	if err := d.deleteSecondaryIPs(ctx); err != nil {
+		log.Warnf("Unable to delete the secondary IPs: %s", err)
+	}
+
+	d.invalidateState()
+	if err := d.api().terminateUHost(ctx); err != nil {
+		return fmt.Errorf("Unable to terminate the UHost instance: %w", err)
+	}
+	d.closeTunnel()
+
+	// the EIP and security group can only be released after the uhost is gone
+	if err := d.waitFor(d.uhostTerminatedFunc(ctx), 3*time.Minute); err != nil {
+		log.Warnf("wait for UHost terminated failed: %s", err)
+	}
+
+	if d.EIPId != "" && !d.ExistingEIP {
+		if err := d.releaseEIP(ctx); err != nil {
+			log.Warnf("Unable to release the EIP(%s): %s", d.EIPId, err)
+		}
+	}
+
+	if err := d.deleteSecondaryNIC(ctx); err != nil {
+		log.Warnf("Unable to delete the network interface(%s): %s", d.NetworkInterfaceId, err)
+	}
+
+	// the security group may be still used by other uhosts
+	if d.SecurityGroupCreated && d.SecurityGroupId != 0 {
+		if err := d.deleteSecurityGroup(ctx, d.SecurityGroupId); err != nil {
+			log.Warnf("Unable to delete the security group(%d): %s", d.SecurityGroupId, err)
+		}
+	}
+
+	if err := d.detachNATGW(ctx); err != nil {
+		log.Warnf("Unable to release the NAT gateway(%s): %s", d.NATGWId, err)
+	}
+
+	// the VPC may be still used by other uhosts
+	if err := d.deleteVPC(ctx); err != nil {
+		log.Warnf("Unable to delete the VPC: %s", err)
+	}
+
+	if err := d.deleteKeyPair(ctx); err != nil {
+		log.Warnf("Unable to delete the key pair(%s): %s", d.KeyPairId, err)
+	}
+
+	if d.RemoveAllResources {
+		return d.removeLeftResources(ctx)
+	}
+
+	return nil
+}
+
+// keepDataDisks detach the data disks created with uhost and name them after
+// the machine, so that they are not released with the uhost and can be
+// attached to another machine with --ucloud-udisk-id
+func (d *Driver) keepDataDisks(ctx context.Context) error {
+	details, err := d.api().getHostDescription(ctx)
+	if err != nil {
+		return fmt.Errorf("get host detail failed: %w", err)
+	}
+	diskIds := dataDiskIds(details.disks, d.UDiskIds)
+	if len(diskIds) == 0 {
+		return nil
+	}
+
+	// the data written by docker must be flushed before detaching
+	if _, err := d.stopForMaintenance(ctx, "detach the data disks"); err != nil {
+		return err
+	}
+
+	kept := make(map[string]bool)
+	for i, diskId := range diskIds {
+		if err := d.detachUDisk(ctx, details.zone, diskId); err != nil {
+			return err
+		}
+		kept[diskId] = true
+
+		name := keptDiskName(d.MachineName, i)
+		if err := d.renameUDisk(ctx, details.zone, diskId, name); err != nil {
+			log.Warnf("Unable to rename the disk(%s): %s", diskId, err)
+		}
+		log.Infof("Data disk %s(%s) is kept, attach it with --ucloud-udisk-id %s", name, diskId, diskId)
+	}
+
+	// the disks must be detached before the uhost is terminated
+	if err := d.waitFor(func() bool {
+		details, err := d.api().getHostDescription(ctx)
+		return err == nil && len(dataDiskIds(details.disks, d.UDiskIds)) == 0
+	}, 3*time.Minute); err != nil {
+		return fmt.Errorf("wait for data disks detached failed: %w", err)
+	}
+
+	// the kept disks are not deleted with --ucloud-remove-all-resources
+	var diskIdsLeft []string
+	for _, diskId := range d.DiskIds {
+		if !kept[diskId] {
+			diskIdsLeft = append(diskIdsLeft, diskId)
+		}
+	}
+	d.DiskIds = diskIdsLeft
+
+	return nil
+}
+
+// removeLeftResources delete the disks which are not released with the uhost,
+// and verify the disks, EIP and security group created by driver are gone so
+// that no billing items are left
+func (d *Driver) removeLeftResources(ctx context.Context) error {
+	var left []string
+
+	for _, diskId := range d.DiskIds {
+		exists, err := d.udiskExists(ctx, diskId)
+		if err == nil && exists {
+			log.Infof("Deleting the disk %s...", diskId)
+			if err := d.deleteUDisk(ctx, diskId); err != nil {
+				log.Warnf("Unable to delete the disk(%s): %s", diskId, err)
+			}
+			exists, err = d.udiskExists(ctx, diskId)
+		}
+		if err != nil || exists {
+			left = append(left, "disk "+diskId)
+		}
+	}
+
+	if d.EIPId != "" && !d.ExistingEIP {
+		if exists, err := d.eipExists(ctx, d.EIPId); err != nil || exists {
+			left = append(left, "EIP "+d.EIPId)
+		}
+	}
+
+	if d.SecurityGroupCreated && d.SecurityGroupId != 0 {
+		if exists, err := d.securityGroupExists(ctx, d.SecurityGroupId); err != nil || exists {
+			left = append(left, fmt.Sprintf("security group %d", d.SecurityGroupId))
+		}
+	}
+
+	if len(left) > 0 {
+		return fmt.Errorf("Unable to release the resources of machine %s: %s", d.MachineName, strings.Join(left, ", "))
 	}
 
-	//TODO: any cleanup ?
 	return nil
 }
 
 func (d *Driver) Restart() error {
+	ctx := context.Background()
 	log.Debug("Restarting...")
-	if err := d.rebootUHost(); err != nil {
-		return fmt.Errorf("Unable to restart the UHost instance: %s", err)
+	d.invalidateState()
+	if err := d.api().rebootUHost(ctx); err != nil {
+		return fmt.Errorf("Unable to restart the UHost instance: %w", err)
+	}
+
+	if err := d.waitFor(drivers.MachineInState(d, state.Running), d.createTimeout()); err != nil {
+		return fmt.Errorf("wait for machine running failed: %w", err)
+	}
+
+	// the IP address may be changed after reboot
+	if err := d.refreshIPAddress(ctx); err != nil {
+		return fmt.Errorf("refresh IP address failed:%w", err)
 	}
 
 	return nil
 }
 
+// Kill power off the uhost forcibly, it works on the hung guests which ignore
+// the ACPI shutdown
 func (d *Driver) Kill() error {
+	ctx := context.Background()
 	log.Debug("Killing...")
-	if err := d.killUHost(); err != nil {
-		return fmt.Errorf("Unable to kill the UHost instance: %s", err)
+	d.invalidateState()
+	if err := d.api().killUHost(ctx); err != nil {
+		return fmt.Errorf("Unable to kill the UHost instance: %w", err)
+	}
+	d.closeTunnel()
+
+	if err := d.waitFor(drivers.MachineInState(d, state.Stopped), 3*time.Minute); err != nil {
+		return fmt.Errorf("wait for machine stopped failed: %w", err)
+	}
+
+	return nil
+}
+
+// stopForMaintenance stop the machine for the operation which can only be done
+// on a stopped uhost, the state before stopping is returned
+func (d *Driver) stopForMaintenance(ctx context.Context, operation string) (state.State, error) {
+	st, err := d.GetState()
+	if err != nil {
+		return st, err
+	}
+
+	if st != state.Stopped {
+		log.Infof("Stopping machine %s to %s...", d.MachineName, operation)
+		d.invalidateState()
+		if err := d.api().stopUHost(ctx); err != nil {
+			return st, fmt.Errorf("Unable to stop the UHost instance: %w", err)
+		}
+		if err := d.waitFor(drivers.MachineInState(d, state.Stopped), 6*time.Minute); err != nil {
+			return st, fmt.Errorf("wait for machine stopped failed: %w", err)
+		}
+	}
+
+	return st, nil
+}
+
+// startAfterMaintenance start the machine stopped by stopForMaintenance if it
+// was running in st and wait for it to run. It is deferred by the callers so
+// the machine is not left stopped when the operation fails, the start error
+// is returned in err unless the operation has failed, then it is logged.
+func (d *Driver) startAfterMaintenance(ctx context.Context, st state.State, err *error) {
+	if st != state.Running {
+		return
+	}
+
+	log.Infof("Starting machine %s...", d.MachineName)
+	d.invalidateState()
+	startErr := d.api().startUHost(ctx)
+	if startErr == nil {
+		startErr = d.waitFor(drivers.MachineInState(d, state.Running), 6*time.Minute)
+	}
+	if startErr == nil {
+		return
+	}
+	if *err != nil {
+		log.Warnf("Unable to start the UHost instance: %s", startErr)
+		return
+	}
+	*err = fmt.Errorf("Unable to start the UHost instance: %w", startErr)
+}
+
+// CreateImage create a custom image with name from the machine, the machine
+// is stopped while creating the image and started again if it was running,
+// even if the image fails. The id of the created image is returned.
+func (d *Driver) CreateImage(name string) (imageId string, err error) {
+	ctx := context.Background()
+
+	st, err := d.stopForMaintenance(ctx, "create image")
+	if err != nil {
+		return "", err
+	}
+
+	defer d.startAfterMaintenance(ctx, st, &err)
+
+	log.Infof("Creating image %s...", name)
+	imageId, err = d.createCustomImage(ctx, name)
+	if err != nil {
+		return "", fmt.Errorf("Unable to create image: %w", err)
+	}
+
+	if err := d.waitFor(d.imageAvailableFunc(ctx, imageId), 20*time.Minute); err != nil {
+		return "", fmt.Errorf("wait for image %s available failed: %w", imageId, err)
+	}
+
+	return imageId, nil
+}
+
+// Snapshot create snapshots of the boot and data disks of the machine, the
+// map from disk id to snapshot id is returned for RestoreSnapshot. The
+// snapshots already created are deleted if a disk fails.
+func (d *Driver) Snapshot(name string) (map[string]string, error) {
+	ctx := context.Background()
+
+	details, err := d.api().getHostDescription(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	snapshots := make(map[string]string)
+	for _, disk := range details.disks {
+		log.Infof("Creating snapshot of %s disk %s...", disk.kind, disk.id)
+		snapshotId, err := d.createSnapshot(ctx, disk.id, fmt.Sprintf("%s-%s", name, disk.id))
+		if err != nil {
+			d.deleteSnapshots(ctx, snapshots)
+			return nil, fmt.Errorf("Unable to create snapshot of disk %s: %w", disk.id, err)
+		}
+		snapshots[disk.id] = snapshotId
+	}
+
+	return snapshots, nil
+}
+
+// RestoreSnapshot restore the disks of the machine from the snapshots created
+// by Snapshot, the machine is stopped while restoring and started again if it
+// was running, even if the restore fails.
+func (d *Driver) RestoreSnapshot(snapshots map[string]string) (err error) {
+	ctx := context.Background()
+
+	st, err := d.stopForMaintenance(ctx, "restore snapshots")
+	if err != nil {
+		return err
+	}
+	defer d.startAfterMaintenance(ctx, st, &err)
+
+	for diskId, snapshotId := range snapshots {
+		log.Infof("Restoring disk %s from snapshot %s...", diskId, snapshotId)
+		if err := d.restoreSnapshot(ctx, diskId, snapshotId); err != nil {
+			return fmt.Errorf("Unable to restore disk %s: %w", diskId, err)
+		}
+	}
+
+	return nil
+}
+
+// Resize change the CPU cores, memory size(MB) and disk space(GB) of the
+// machine, zero value keeps the current configuration. The machine is
+// stopped while resizing and started again if it was running, even if the
+// resize fails. The CPU and memory of the running machine with hotplug feature
+// are added online without the stop.
+func (d *Driver) Resize(cpu, memory, diskSpace int) (err error) {
+	ctx := context.Background()
+
+	resized := func() {
+		if cpu > 0 {
+			d.CPU = cpu
+		}
+		if memory > 0 {
+			d.Memory = memory
+		}
+		if diskSpace > 0 {
+			d.DiskSpace = diskSpace
+		}
+	}
+
+	// the downgrade and disk resize still need the stop
+	upgrade := (cpu == 0 || cpu >= d.CPU) && (memory == 0 || memory >= d.Memory)
+	if d.Hotplug && diskSpace == 0 && upgrade {
+		if st, err := d.GetState(); err == nil && st == state.Running {
+			log.Infof("Resizing machine %s online...", d.MachineName)
+			err := d.resizeUHost(ctx, cpu, memory, 0)
+			if err == nil {
+				resized()
+				return nil
+			}
+			log.Warnf("Unable to resize the UHost instance online, it will be stopped: %s", err)
+		}
+	}
+
+	st, err := d.stopForMaintenance(ctx, "resize")
+	if err != nil {
+		return err
+	}
+	defer d.startAfterMaintenance(ctx, st, &err)
+
+	log.Infof("Resizing machine %s...", d.MachineName)
+	if err := d.resizeUHost(ctx, cpu, memory, diskSpace); err != nil {
+		return fmt.Errorf("Unable to resize the UHost instance: %w", err)
+	}
+	resized()
+
+	return nil
+}
+
+// ResetPassword reset the root password of the machine to rotate the leaked
+// bootstrap password, a random one is generated if password is empty. The
+// machine is stopped while resetting and started again if it was running,
+// even if the reset fails. The machine config must be saved after that to
+// persist the new password.
+func (d *Driver) ResetPassword(password string) (err error) {
+	ctx := context.Background()
+
+	if password == "" {
+		if password, err = generateRandomPassword(16); err != nil {
+			return err
+		}
+	}
+
+	st, err := d.stopForMaintenance(ctx, "reset password")
+	if err != nil {
+		return err
+	}
+	defer d.startAfterMaintenance(ctx, st, &err)
+
+	log.Infof("Resetting password of machine %s...", d.MachineName)
+	if err := d.resetPassword(ctx, password); err != nil {
+		return fmt.Errorf("Unable to reset the password: %w", err)
+	}
+	d.Password = password
+
+	return nil
+}
+
+// SetBandwidth change the bandwidth(Mbps) of the EIP bound to the machine, it
+// can be used to boost the machine temporarily without recreating it. The
+// machine config must be saved after that to persist the new bandwidth.
+func (d *Driver) SetBandwidth(bandwidth int) error {
+	ctx := context.Background()
+
+	if d.EIPId == "" {
+		return fmt.Errorf("no EIP is bound to machine %s", d.MachineName)
+	}
+	if d.ShareBandwidthId != "" {
+		return fmt.Errorf("the bandwidth of EIP %s is provided by the shared bandwidth %s", d.EIPId, d.ShareBandwidthId)
+	}
+	if bandwidth <= 0 {
+		return fmt.Errorf("bandwidth must be positive")
+	}
+
+	log.Infof("Changing bandwidth of EIP %s to %dMbps...", d.EIPId, bandwidth)
+	if err := d.modifyEIPBandwidth(ctx, bandwidth); err != nil {
+		return fmt.Errorf("Unable to change the bandwidth of EIP: %w", err)
 	}
+	d.EIPBandwidth = bandwidth
 
 	return nil
 }
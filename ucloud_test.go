@@ -1 +1,562 @@
 package ucloud
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/docker/machine/libmachine/drivers"
+	"github.com/docker/machine/libmachine/state"
+	"github.com/ucloud/ucloud-sdk-go/service/uhost"
+)
+
+// fakeClient is the in-memory UCloud API of the uhost lifecycle
+type fakeClient struct {
+	d        *Driver
+	hosts    map[string]*UHostDetail
+	failUNet bool
+	hung     bool // the uhost ignores the graceful shutdown
+	stops    int
+}
+
+func newFakeDriver(t *testing.T) (*Driver, *fakeClient) {
+	d := NewDriver("ucloud-machine", "")
+	d.StorePath = t.TempDir()
+	if err := os.MkdirAll(filepath.Join(d.StorePath, "machines", d.MachineName), 0700); err != nil {
+		t.Fatal(err)
+	}
+	d.KeyPairLogin = true
+	d.StateCacheTTL = defaultStateCacheTTL
+
+	f := &fakeClient{d: d, hosts: make(map[string]*UHostDetail)}
+	d.client = f
+	return d, f
+}
+
+func (f *fakeClient) ensureVPC(ctx context.Context) error {
+	return nil
+}
+
+func (f *fakeClient) createUHost(ctx context.Context) error {
+	id := fmt.Sprintf("uhost-fake%d", len(f.hosts)+1)
+	f.hosts[id] = &UHostDetail{
+		region:           f.d.Region,
+		zone:             "cn-bj2-02",
+		hostID:           id,
+		state:            "Running",
+		publicIPAddress:  "106.75.0.1",
+		privateIPAddress: "10.10.0.2",
+	}
+	f.d.UhostID = id
+	return nil
+}
+
+func (f *fakeClient) prepareUNet(ctx context.Context) (preparedUNet, error) {
+	return preparedUNet{
+		eipId:                "eip-fake1",
+		ipAddress:            "106.75.0.1",
+		securityGroupId:      100002,
+		securityGroupCreated: true,
+	}, nil
+}
+
+func (f *fakeClient) createUNet(ctx context.Context) error {
+	if f.failUNet {
+		return fmt.Errorf("allocate EIP failed")
+	}
+	f.d.IPAddress = f.hosts[f.d.UhostID].publicIPAddress
+	f.d.PrivateIPAddress = f.hosts[f.d.UhostID].privateIPAddress
+	return nil
+}
+
+func (f *fakeClient) getHostDescription(ctx context.Context) (*UHostDetail, error) {
+	host, ok := f.hosts[f.d.UhostID]
+	if !ok {
+		return nil, errUHostNotExist
+	}
+	detail := *host
+	return &detail, nil
+}
+
+func (f *fakeClient) setState(s string) error {
+	host, ok := f.hosts[f.d.UhostID]
+	if !ok {
+		return errUHostNotExist
+	}
+	host.state = s
+	return nil
+}
+
+func (f *fakeClient) startUHost(ctx context.Context) error { return f.setState("Running") }
+func (f *fakeClient) stopUHost(ctx context.Context) error {
+	f.stops++
+	if f.hung {
+		return nil
+	}
+	return f.setState("Stopped")
+}
+func (f *fakeClient) rebootUHost(ctx context.Context) error { return f.setState("Running") }
+func (f *fakeClient) killUHost(ctx context.Context) error   { return f.setState("Stopped") }
+
+func (f *fakeClient) terminateUHost(ctx context.Context) error {
+	if _, ok := f.hosts[f.d.UhostID]; !ok {
+		return errUHostNotExist
+	}
+	delete(f.hosts, f.d.UhostID)
+	return nil
+}
+
+func assertState(t *testing.T, d *Driver, expected state.State) {
+	t.Helper()
+	s, err := d.GetState()
+	if err != nil {
+		t.Fatalf("get state failed:%s", err)
+	}
+	if s != expected {
+		t.Errorf("expected state %s, got %s", expected, s)
+	}
+}
+
+func TestLifecycle(t *testing.T) {
+	d, f := newFakeDriver(t)
+
+	if err := d.Create(); err != nil {
+		t.Fatalf("create failed:%s", err)
+	}
+	if d.UhostID != "uhost-fake1" {
+		t.Errorf("unexpected uhost id:%s", d.UhostID)
+	}
+	if d.Zone != "cn-bj2-02" {
+		t.Errorf("zone of uhost should be recorded, got:%s", d.Zone)
+	}
+	if d.EIPId != "eip-fake1" || d.SecurityGroupId != 100002 || !d.SecurityGroupCreated {
+		t.Errorf("prepared networks should be set, EIP:%s, security group:%d, created:%t", d.EIPId, d.SecurityGroupId, d.SecurityGroupCreated)
+	}
+	assertState(t, d, state.Running)
+	if ip, err := d.GetIP(); err != nil || ip != "106.75.0.1" {
+		t.Errorf("unexpected IP:%s, err:%v", ip, err)
+	}
+
+	if err := d.Stop(); err != nil {
+		t.Fatalf("stop failed:%s", err)
+	}
+	assertState(t, d, state.Stopped)
+
+	if err := d.Start(); err != nil {
+		t.Fatalf("start failed:%s", err)
+	}
+	assertState(t, d, state.Running)
+
+	f.hosts[d.UhostID].publicIPAddress = "106.75.0.2"
+	if err := d.Restart(); err != nil {
+		t.Fatalf("restart failed:%s", err)
+	}
+	assertState(t, d, state.Running)
+	if d.IPAddress != "106.75.0.2" {
+		t.Errorf("IP address should be refreshed after restart, got:%s", d.IPAddress)
+	}
+
+	if err := d.Kill(); err != nil {
+		t.Fatalf("kill failed:%s", err)
+	}
+	assertState(t, d, state.Stopped)
+
+	if err := d.Remove(); err != nil {
+		t.Fatalf("remove failed:%s", err)
+	}
+	if len(f.hosts) != 0 {
+		t.Errorf("uhost should be terminated, hosts:%v", f.hosts)
+	}
+	if _, err := d.GetState(); err != errUHostNotExist {
+		t.Errorf("expected errUHostNotExist, got:%v", err)
+	}
+}
+
+func TestRemoveDeleteProtection(t *testing.T) {
+	d, f := newFakeDriver(t)
+	if err := d.Create(); err != nil {
+		t.Fatalf("create failed:%s", err)
+	}
+
+	d.DeleteProtection = true
+	t.Setenv(forceRemoveEnv, "")
+	if err := d.Remove(); err == nil || !strings.Contains(err.Error(), d.UhostID) || !strings.Contains(err.Error(), d.EIPId) {
+		t.Errorf("remove the protected machine should fail with the kept resources, got:%v", err)
+	}
+	if len(f.hosts) != 1 {
+		t.Errorf("the protected uhost should not be terminated, hosts:%v", f.hosts)
+	}
+
+	t.Setenv(forceRemoveEnv, "1")
+	if err := d.Remove(); err != nil {
+		t.Fatalf("force remove failed:%s", err)
+	}
+	if len(f.hosts) != 0 {
+		t.Errorf("uhost should be terminated, hosts:%v", f.hosts)
+	}
+}
+
+func TestDataDiskIds(t *testing.T) {
+	disks := []UHostDisk{
+		{id: "bsi-boot", kind: "Boot", size: 20},
+		{id: "bsi-data", kind: "Data", size: 100},
+		{id: "bs-udisk", kind: "Udisk", size: 200},
+	}
+
+	ids := dataDiskIds(disks, []string{"bs-udisk"})
+	if len(ids) != 1 || ids[0] != "bsi-data" {
+		t.Errorf("expected data disks:[bsi-data], got:%v", ids)
+	}
+
+	if name := keptDiskName("ucloud-machine", 0); name != "ucloud-machine-data-1" {
+		t.Errorf("expected name:ucloud-machine-data-1, got:%s", name)
+	}
+}
+
+func TestResizeHotplug(t *testing.T) {
+	d, f := newFakeDriver(t)
+	if err := d.Create(); err != nil {
+		t.Fatalf("create failed:%s", err)
+	}
+
+	d.Hotplug = true
+	if err := d.Resize(d.CPU*2, 0, 0); err != nil {
+		t.Fatalf("resize failed:%s", err)
+	}
+	if f.stops != 0 {
+		t.Errorf("the uhost with hotplug should be upgraded online, stops:%d", f.stops)
+	}
+
+	// the downgrade needs the stop
+	if err := d.Resize(d.CPU/2, 0, 0); err != nil {
+		t.Fatalf("resize failed:%s", err)
+	}
+	if f.stops != 1 {
+		t.Errorf("the uhost should be stopped for downgrade, stops:%d", f.stops)
+	}
+}
+
+func TestResizeStopped(t *testing.T) {
+	d, _ := newFakeDriver(t)
+	if err := d.Create(); err != nil {
+		t.Fatalf("create failed:%s", err)
+	}
+	if err := d.Stop(); err != nil {
+		t.Fatalf("stop failed:%s", err)
+	}
+
+	if err := d.Resize(d.CPU*2, 0, 0); err != nil {
+		t.Fatalf("resize failed:%s", err)
+	}
+	assertState(t, d, state.Stopped)
+}
+
+func TestResizeFailedStarted(t *testing.T) {
+	d, _ := newFakeDriver(t)
+	if err := d.Create(); err != nil {
+		t.Fatalf("create failed:%s", err)
+	}
+	d.transport = newReplayer(t, interaction{
+		Action:   "ResizeUHostInstance",
+		Status:   http.StatusOK,
+		Response: `{"Action":"ResizeUHostInstanceResponse","RetCode":8000,"Message":"resize failed"}`,
+	})
+
+	if err := d.Resize(d.CPU*2, 0, 0); err == nil {
+		t.Fatal("the failed resize should return error")
+	}
+	assertState(t, d, state.Running)
+}
+
+func TestGetPrivateIPs(t *testing.T) {
+	d, _ := newFakeDriver(t)
+	if err := d.Create(); err != nil {
+		t.Fatalf("create failed:%s", err)
+	}
+	if ips := d.GetPrivateIPs(); len(ips) != 1 || ips[0] != "10.10.0.2" {
+		t.Errorf("expected private IPs:[10.10.0.2], got:%v", ips)
+	}
+
+	d.SecondaryIPAddress = "10.20.0.2"
+	if ips := d.GetPrivateIPs(); len(ips) != 2 || ips[1] != "10.20.0.2" {
+		t.Errorf("expected the secondary IP 10.20.0.2, got:%v", ips)
+	}
+
+	d.SecondaryIPs = []string{"10.10.0.3"}
+	if ips := d.GetPrivateIPs(); len(ips) != 3 || ips[2] != "10.10.0.3" {
+		t.Errorf("expected the secondary private IP 10.10.0.3, got:%v", ips)
+	}
+}
+
+func TestGetStateCache(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	stateClock = func() time.Time { return now }
+	t.Cleanup(func() { stateClock = time.Now })
+
+	d, f := newFakeDriver(t)
+	if err := d.Create(); err != nil {
+		t.Fatalf("create failed:%s", err)
+	}
+	assertState(t, d, state.Running)
+
+	// the state changed outside of the driver is got after the ttl
+	f.hosts[d.UhostID].state = "Stopped"
+	now = now.Add(time.Duration(d.StateCacheTTL)*time.Second - time.Millisecond)
+	assertState(t, d, state.Running)
+
+	now = now.Add(time.Millisecond)
+	assertState(t, d, state.Stopped)
+}
+
+func TestGetStateMapping(t *testing.T) {
+	d, f := newFakeDriver(t)
+	d.StateCacheTTL = 0
+	if err := d.Create(); err != nil {
+		t.Fatalf("create failed:%s", err)
+	}
+
+	for uhostState, expected := range map[string]state.State{
+		"Migrating":     state.Running,
+		"Resizing":      state.Starting,
+		"ReinstallFail": state.Error,
+		"Hibernating":   state.Error,
+	} {
+		f.hosts[d.UhostID].state = uhostState
+		assertState(t, d, expected)
+	}
+}
+
+func TestStopHungUHost(t *testing.T) {
+	d, f := newFakeDriver(t)
+	if err := d.Create(); err != nil {
+		t.Fatalf("create failed:%s", err)
+	}
+
+	f.hung = true
+	d.PollInterval = 1
+	d.StopTimeout = 1
+	if err := d.Stop(); err != nil {
+		t.Fatalf("stop failed:%s", err)
+	}
+	assertState(t, d, state.Stopped)
+}
+
+func TestCreateRollback(t *testing.T) {
+	d, f := newFakeDriver(t)
+	f.failUNet = true
+
+	if err := d.Create(); err == nil {
+		t.Fatal("create should fail when the network is not created")
+	}
+	if len(f.hosts) != 0 {
+		t.Errorf("the created uhost should be terminated, hosts:%v", f.hosts)
+	}
+}
+
+func TestDefaultSecurityGroupRules(t *testing.T) {
+	d := NewDriver("ucloud-machine", "")
+
+	rules := strings.Join(d.defaultSecurityGroupRules(), ",")
+	if strings.Contains(rules, "7946") {
+		t.Errorf("swarm ports should not be opened without swarm, rules:%s", rules)
+	}
+	if !strings.Contains(rules, "TCP|2376|0.0.0.0/0|ACCEPT|50") {
+		t.Errorf("the default Docker port should be opened, rules:%s", rules)
+	}
+
+	d.DockerPort = 12376
+	rules = strings.Join(d.defaultSecurityGroupRules(), ",")
+	if !strings.Contains(rules, "TCP|12376|0.0.0.0/0|ACCEPT|50") || strings.Contains(rules, "TCP|2376|") {
+		t.Errorf("only the custom Docker port should be opened, rules:%s", rules)
+	}
+
+	d.BaseDriver = &drivers.BaseDriver{
+		SwarmMaster:    true,
+		SwarmDiscovery: "token://1234",
+	}
+	rules = strings.Join(d.defaultSecurityGroupRules(), ",")
+	for _, rule := range []string{
+		"TCP|3376|0.0.0.0/0|ACCEPT|50",
+		"TCP|2377|0.0.0.0/0|ACCEPT|50",
+		"TCP|7946|0.0.0.0/0|ACCEPT|50",
+		"UDP|7946|0.0.0.0/0|ACCEPT|50",
+		"UDP|4789|0.0.0.0/0|ACCEPT|50",
+	} {
+		if !strings.Contains(rules, rule) {
+			t.Errorf("rule:%s is not found in rules:%s", rule, rules)
+		}
+	}
+}
+
+func TestSecurityGroupRules(t *testing.T) {
+	d := NewDriver("ucloud-machine", "")
+	d.OpenPorts = []string{"8080/tcp", "8000-8100/udp", "443"}
+
+	rules := strings.Join(d.securityGroupRules(), ",")
+	for _, rule := range []string{
+		"TCP|2376|0.0.0.0/0|ACCEPT|50",
+		"TCP|8080|0.0.0.0/0|ACCEPT|50",
+		"UDP|8000-8100|0.0.0.0/0|ACCEPT|50",
+		"TCP|443|0.0.0.0/0|ACCEPT|50",
+	} {
+		if !strings.Contains(rules, rule) {
+			t.Errorf("rule:%s is not found in rules:%s", rule, rules)
+		}
+	}
+
+	d.SecurityGroupRules = []string{"TCP|22|10.0.0.0/8|ACCEPT|50"}
+	rules = strings.Join(d.securityGroupRules(), ",")
+	if rules != "TCP|22|10.0.0.0/8|ACCEPT|50,TCP|8080|0.0.0.0/0|ACCEPT|50,UDP|8000-8100|0.0.0.0/0|ACCEPT|50,TCP|443|0.0.0.0/0|ACCEPT|50" {
+		t.Errorf("open ports should be appended to the custom rules, rules:%s", rules)
+	}
+}
+
+func TestZoneInStock(t *testing.T) {
+	sizes := []uhost.MachineSizes{{Collection: []uhost.Collection{{Cpu: 1, Memory: []int{1, 2}}, {Cpu: 2, Memory: []int{4}}}}}
+	types := []uhost.AvailableInstanceType{
+		{Name: "N", Zone: "cn-bj2-05", Status: "SoldOut", MachineSizes: sizes},
+		{Name: "N", Zone: "cn-bj2-04", Status: "Normal", MachineSizes: sizes},
+		{Name: "O", Zone: "cn-bj2-02", Status: "Normal", MachineSizes: sizes},
+	}
+
+	cases := []struct {
+		machineType string
+		cpu, memory int
+		expected    string
+	}{
+		{"", 1, 2048, "cn-bj2-02"},
+		{"N", 2, 4096, "cn-bj2-04"},
+		{"N", 2, 2048, ""},
+		{"C", 1, 1024, ""},
+	}
+	for _, c := range cases {
+		if zone := zoneInStock(types, c.machineType, c.cpu, c.memory); zone != c.expected {
+			t.Errorf("expected zone %q of %s %dC%dM, got %q", c.expected, c.machineType, c.cpu, c.memory, zone)
+		}
+	}
+}
+
+func TestWaitAttempts(t *testing.T) {
+	d := NewDriver("ucloud-machine", "")
+
+	if attempts := d.waitAttempts(d.createTimeout()); attempts != defaultCreateTimeout/defaultPollInterval {
+		t.Errorf("default attempts should be %d, got %d", defaultCreateTimeout/defaultPollInterval, attempts)
+	}
+	if retries := d.retries(); retries != defaultRetries {
+		t.Errorf("default retries should be %d, got %d", defaultRetries, retries)
+	}
+
+	d.CreateTimeout = 1
+	d.RetryCount = 3
+	if attempts := d.waitAttempts(d.createTimeout()); attempts != 1 {
+		t.Errorf("attempts should be at least 1, got %d", attempts)
+	}
+	if retries := d.retries(); retries != 3 {
+		t.Errorf("retries should be 3, got %d", retries)
+	}
+
+	d.CreateTimeout = 60
+	d.PollInterval = 10
+	if attempts := d.waitAttempts(d.createTimeout()); attempts != 6 {
+		t.Errorf("attempts should be 6, got %d", attempts)
+	}
+}
+
+func TestCreateNATGWFirewall(t *testing.T) {
+	d, _ := newFakeDriver(t)
+	d.SecurityGroupId = 100002
+	d.EIPChargeMode = defaultEIPChargeMode
+	name := natgwFirewallName(d.MachineName)
+	firewall := fmt.Sprintf(`"DataSet":[{"GroupId":100003,"GroupName":"%s"}]`, name)
+	r := newReplayer(t,
+		replay("CreateSecurityGroup", ""),
+		replay("DescribeSecurityGroup", firewall),
+		replay("DescribeSecurityGroup", firewall),
+		replay("AllocateEIP", `"EIPSet":[{"EIPId":"eip-natgw","EIPAddr":[{"OperatorName":"Bgp","IP":"106.75.0.9"}]}]`),
+		replay("CreateNATGW", `"NATGWId":"natgw-1"`),
+	)
+	d.transport = r
+
+	if err := d.createNATGW(context.Background(), "uvnet-1", "subnet-1"); err != nil {
+		t.Fatalf("create NAT gateway failed:%s", err)
+	}
+	if d.NATGWId != "natgw-1" || d.NATGWFirewallId != 100003 || !d.NATGWFirewallCreated {
+		t.Errorf("unexpected NAT gateway:%s, firewall:%d, created:%t", d.NATGWId, d.NATGWFirewallId, d.NATGWFirewallCreated)
+	}
+	if firewallId := r.sent[len(r.sent)-1].Get("FirewallId"); firewallId != "100003" {
+		t.Errorf("NAT gateway should use its own firewall, got:%s", firewallId)
+	}
+	if group := r.sent[0].Get("GroupName"); group != name {
+		t.Errorf("unexpected firewall name:%s", group)
+	}
+}
+
+func TestListImagesPaged(t *testing.T) {
+	d, _ := newFakeDriver(t)
+	r := newReplayer(t,
+		replay("DescribeImage", `"TotalCount":2,"ImageSet":[{"ImageId":"uimage-1","OsName":"CentOS 7.9 64","State":"Available"}]`),
+		replay("DescribeImage", `"TotalCount":2,"ImageSet":[{"ImageId":"uimage-2","OsName":"Ubuntu 22.04","State":"Available"}]`),
+	)
+	d.transport = r
+
+	images, err := d.listImages(context.Background(), "cn-bj2")
+	if err != nil {
+		t.Fatalf("list images failed:%s", err)
+	}
+	if len(images) != 2 || images[1].Id != "uimage-2" {
+		t.Errorf("expected the images of both pages, got:%v", images)
+	}
+	if offset := r.sent[1].Get("Offset"); offset != "1" {
+		t.Errorf("expected the second page at offset 1, got:%s", offset)
+	}
+}
+
+func TestDetachNATGWLastSubnet(t *testing.T) {
+	d, _ := newFakeDriver(t)
+	d.NATGWId = "natgw-1"
+	d.NATGWCreated = true
+	d.NATGWFirewallId = 100003
+	d.NATGWFirewallCreated = true
+	d.NATGWSubnetId = "subnet-1"
+	d.SubnetCreated = true
+	r := newReplayer(t,
+		replay("DeleteNATGW", ""),
+		replay("DeleteSecurityGroup", ""),
+	)
+	d.transport = r
+
+	if err := d.detachNATGW(context.Background()); err != nil {
+		t.Fatalf("detach NAT gateway failed:%s", err)
+	}
+	if release := r.sent[0].Get("ReleaseEip"); release != "true" {
+		t.Errorf("EIP of the created NAT gateway should be released, ReleaseEip:%s", release)
+	}
+	if groupId := r.sent[1].Get("GroupId"); groupId != "100003" {
+		t.Errorf("unexpected firewall deleted:%s", groupId)
+	}
+}
+
+func TestDetachNATGWLastSubnetUserOwned(t *testing.T) {
+	d, _ := newFakeDriver(t)
+	d.NATGWId = "natgw-1"
+	d.NATGWSubnetId = "subnet-1"
+	d.SubnetCreated = true
+	r := newReplayer(t,
+		replay("DescribeNATGW", `"DataSet":[{"NATGWId":"natgw-1","SubnetSet":[{"SubnetworkId":"subnet-1"}]}]`),
+	)
+	d.transport = r
+
+	// the NAT gateway is not created by driver, it is kept with the subnet
+	// attached rather than deleted or left without subnet
+	if err := d.detachNATGW(context.Background()); err != nil {
+		t.Fatalf("detach NAT gateway failed:%s", err)
+	}
+	if len(r.sent) != 1 {
+		t.Errorf("NAT gateway of user should not be changed, sent %d requests", len(r.sent))
+	}
+}
@@ -1,27 +1,109 @@
 package ucloud
 
 import (
+	"crypto/rand"
+	"encoding/base64"
 	"errors"
-	"math/rand"
+	"fmt"
+	"math/big"
+	"net"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 )
 
+var sshUserRegexp = regexp.MustCompile(`^[a-z_][a-z0-9_-]{0,31}$`)
+
+// the causes of driver failures, the programs embedding the driver can check
+// them with errors.Is
+var (
+	ErrAuthFailed         = errors.New("authentication failed")
+	ErrInvalidImage       = errors.New("invalid image")
+	ErrInvalidMachineType = errors.New("invalid machine type")
+	ErrQuotaExceeded      = errors.New("quota exceeded")
+	ErrNoStock            = errors.New("no stock")
+	ErrUHostExists        = errors.New("uhost already exists")
+)
+
+// Error is the driver failure with the cause
+type Error struct {
+	Cause   error
+	Message string
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+func (e *Error) Unwrap() error {
+	return e.Cause
+}
+
+// newError create an Error with the cause and the formatted message
+func newError(cause error, format string, args ...interface{}) error {
+	return &Error{Cause: cause, Message: fmt.Sprintf(format, args...)}
+}
+
 var (
 	errInvalidRegion = errors.New("invalid region specified")
+	errInvalidZone   = errors.New("invalid zone specified")
+
+	errInvalidArch     = errors.New("invalid architecture specified")
+	errInvalidDiskType = errors.New("invalid disk type specified")
+
+	errInvalidEIPChargeMode = errors.New("invalid EIP charge mode specified")
+	errInvalidEIPOperator   = errors.New("invalid EIP operator specified")
+	errInvalidRule          = errors.New("invalid security group rule specified")
+	errInvalidOpenPort      = errors.New("invalid open port specified")
+	errInvalidChargeType    = errors.New("invalid charge type specified")
+	errInvalidSSHUser       = errors.New("invalid SSH user specified")
+	errInvalidNetCapability = errors.New("invalid net capability specified")
+
+	errUHostNotExist = errors.New("UHost is not exist")
 )
 
+// regions is the builtin region list, it is used as a fallback when the
+// GetRegion API is not available
 var regions = []string{
-	"cn-north-01",
-	"cn-north-02",
-	"cn-north-03",
-	"cn-east-01",
-	"cn-south-01",
-	"cn-south-02",
-	"hk-01",
-	"us-west-01",
+	"cn-bj1",
+	"cn-bj2",
+	"cn-zj",
+	"cn-sh1",
+	"cn-sh2",
+	"cn-gd",
+	"hk",
+	"us-ca",
+}
+
+// regionAliases map the deprecated region names to the current ones
+var regionAliases = map[string]string{
+	"cn-north-01": "cn-bj1",
+	"cn-north-02": "cn-bj2",
+	"cn-north-03": "cn-bj2",
+	"cn-north-04": "cn-bj2",
+	"cn-east-01":  "cn-zj",
+	"cn-east-02":  "cn-sh1",
+	"cn-south-01": "cn-gd",
+	"cn-south-02": "hk",
+	"hk-01":       "hk",
+	"us-west-01":  "us-ca",
 }
 
+// canonicalRegion translate the deprecated region name to the current one,
+// whether the name is deprecated is returned as well
+func canonicalRegion(region string) (string, bool) {
+	if current, ok := regionAliases[region]; ok {
+		return current, true
+	}
+	return region, false
+}
+
+// validateUCloudRegion check the region with the builtin region list, the
+// current name of the deprecated region is returned
 func validateUCloudRegion(region string) (string, error) {
+	region, _ = canonicalRegion(region)
 	for _, v := range regions {
 		if v == region {
 			return region, nil
@@ -31,6 +113,167 @@ func validateUCloudRegion(region string) (string, error) {
 	return "", errInvalidRegion
 }
 
+func validateUCloudZone(zone string, zones []string) error {
+	for _, v := range zones {
+		if v == zone {
+			return nil
+		}
+	}
+
+	return errInvalidZone
+}
+
+func validateMachineType(machineType string, machineTypes []string) error {
+	for _, v := range machineTypes {
+		if v == machineType {
+			return nil
+		}
+	}
+
+	return ErrInvalidMachineType
+}
+
+const (
+	archX86 = "x86_64"
+	archARM = "aarch64"
+)
+
+func validateArch(arch string) error {
+	if arch == archX86 || arch == archARM {
+		return nil
+	}
+
+	return errInvalidArch
+}
+
+// imageArch get the architecture of image, the ARM images are named with
+// aarch64 or arm64
+func imageArch(osName, name string) string {
+	for _, s := range []string{osName, name} {
+		s = strings.ToLower(s)
+		if strings.Contains(s, "aarch64") || strings.Contains(s, "arm64") {
+			return archARM
+		}
+	}
+
+	return archX86
+}
+
+var diskTypes = []string{
+	"LOCAL_NORMAL",
+	"LOCAL_SSD",
+	"CLOUD_NORMAL",
+	"CLOUD_SSD",
+	"CLOUD_RSSD",
+}
+
+func validateDiskType(diskType string) error {
+	for _, v := range diskTypes {
+		if v == diskType {
+			return nil
+		}
+	}
+
+	return errInvalidDiskType
+}
+
+// eipPayModes maps the EIP charge mode of flag to the PayMode of API
+var eipPayModes = map[string]string{
+	"PayByBandwidth": "Bandwidth",
+	"PayByTraffic":   "Traffic",
+}
+
+func eipPayMode(chargeMode string) (string, error) {
+	if payMode, ok := eipPayModes[chargeMode]; ok {
+		return payMode, nil
+	}
+
+	return "", errInvalidEIPChargeMode
+}
+
+var eipOperators = []string{
+	"Bgp",
+	"International",
+	"Telecom",
+	"Unicom",
+	"Duplet",
+}
+
+func validateEIPOperator(operator string) error {
+	for _, v := range eipOperators {
+		if v == operator {
+			return nil
+		}
+	}
+
+	return errInvalidEIPOperator
+}
+
+// eipOperator get the operator of EIP, International is used by default out
+// of the cn-* regions since they reject Bgp
+func eipOperator(operator, region string) string {
+	if operator != "" {
+		return operator
+	}
+	if strings.HasPrefix(region, "cn-") {
+		return "Bgp"
+	}
+	return "International"
+}
+
+// hoursPerMonth is used to estimate the monthly price of the hourly charge
+const hoursPerMonth = 24 * 30
+
+// monthlyPrice convert the price of one unit of charge type to the price per
+// month
+func monthlyPrice(price float64, chargeType string) float64 {
+	switch chargeType {
+	case "Dynamic":
+		return price * hoursPerMonth
+	case "Year":
+		return price / 12
+	case "Trial":
+		return 0
+	default:
+		return price
+	}
+}
+
+var chargeTypes = []string{
+	"Year",
+	"Month",
+	"Dynamic",
+	"Trial",
+}
+
+func validateChargeType(chargeType string) error {
+	for _, v := range chargeTypes {
+		if v == chargeType {
+			return nil
+		}
+	}
+
+	return errInvalidChargeType
+}
+
+// netCapabilities is the network enhancement of UHost, Super and Ultra are the
+// enhanced networks of 10G and 25G
+var netCapabilities = []string{
+	"Normal",
+	"Super",
+	"Ultra",
+}
+
+func validateNetCapability(netCapability string) error {
+	for _, v := range netCapabilities {
+		if v == netCapability {
+			return nil
+		}
+	}
+
+	return errInvalidNetCapability
+}
+
 func validPort(port int) bool {
 	if port < 1 || port > 65535 {
 		return false
@@ -38,14 +281,411 @@ func validPort(port int) bool {
 
 	return true
 }
-func generateRandomPassword(n int) string {
-	rand.Seed(time.Now().UnixNano())
-	var letters = []rune("abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ~!@#$%^&*()_+}{:?><")
+
+// validateSecurityGroupRule validate the rule in format of
+// Protocol|Port|CIDR|Action|Priority, such as TCP|22|0.0.0.0/0|ACCEPT|50,
+// port can be a range like 8000-8080 and is ignored by ICMP and GRE.
+func validateSecurityGroupRule(rule string) error {
+	parts := strings.Split(rule, "|")
+	if len(parts) != 5 {
+		return errInvalidRule
+	}
+
+	switch parts[0] {
+	case "TCP", "UDP":
+		for _, p := range strings.SplitN(parts[1], "-", 2) {
+			port, err := strconv.Atoi(p)
+			if err != nil || !validPort(port) {
+				return errInvalidRule
+			}
+		}
+	case "ICMP", "GRE":
+	default:
+		return errInvalidRule
+	}
+
+	if _, _, err := net.ParseCIDR(parts[2]); err != nil {
+		return errInvalidRule
+	}
+
+	if parts[3] != "ACCEPT" && parts[3] != "DROP" {
+		return errInvalidRule
+	}
+
+	switch parts[4] {
+	case "50", "100", "150":
+	default:
+		return errInvalidRule
+	}
+
+	return nil
+}
+
+// natgwFirewallRules is the rules of the firewall created for the NAT
+// gateway, only the traffic from the private networks is accepted
+var natgwFirewallRules = []string{
+	"TCP|1-65535|10.0.0.0/8|ACCEPT|50",
+	"UDP|1-65535|10.0.0.0/8|ACCEPT|50",
+	"ICMP||10.0.0.0/8|ACCEPT|50",
+	"TCP|1-65535|172.16.0.0/12|ACCEPT|50",
+	"UDP|1-65535|172.16.0.0/12|ACCEPT|50",
+	"ICMP||172.16.0.0/12|ACCEPT|50",
+	"TCP|1-65535|192.168.0.0/16|ACCEPT|50",
+	"UDP|1-65535|192.168.0.0/16|ACCEPT|50",
+	"ICMP||192.168.0.0/16|ACCEPT|50",
+}
+
+// natgwFirewallName get the name of the firewall created for the NAT gateway
+// of machine
+func natgwFirewallName(machineName string) string {
+	return "docker-machine-natgw-" + machineName
+}
+
+// keyPairName get the name of the key pair imported for machine at now
+func keyPairName(machineName string, now time.Time) string {
+	return machineName + "-" + now.Format("20060102150405")
+}
+
+// openPortRule get the ACCEPT rule of the port in format of Port[/Protocol],
+// like 8080/tcp or 8000-8100/udp, the protocol is TCP by default
+func openPortRule(port string) (string, error) {
+	protocol := "TCP"
+	if i := strings.Index(port, "/"); i >= 0 {
+		port, protocol = port[:i], strings.ToUpper(port[i+1:])
+	}
+	if protocol != "TCP" && protocol != "UDP" {
+		return "", errInvalidOpenPort
+	}
+
+	rule := fmt.Sprintf("%s|%s|0.0.0.0/0|ACCEPT|50", protocol, port)
+	if err := validateSecurityGroupRule(rule); err != nil {
+		return "", errInvalidOpenPort
+	}
+
+	return rule, nil
+}
+
+// closestImages get at most n images whose id or os name is closest to target
+func closestImages(target string, images []Image, n int) []Image {
+	target = strings.ToLower(target)
+	distance := func(i Image) int {
+		d := levenshtein(target, strings.ToLower(i.Id))
+		if nd := levenshtein(target, strings.ToLower(i.OsName)); nd < d {
+			d = nd
+		}
+		return d
+	}
+
+	sorted := make([]Image, len(images))
+	copy(sorted, images)
+	sort.SliceStable(sorted, func(a, b int) bool {
+		return distance(sorted[a]) < distance(sorted[b])
+	})
+
+	if len(sorted) > n {
+		sorted = sorted[:n]
+	}
+
+	return sorted
+}
+
+// newestImage get the newest Linux image whose OS name or name contains name,
+// the case and spaces are ignored
+func newestImage(name string, images []Image) *Image {
+	normalize := func(s string) string {
+		return strings.Join(strings.Fields(strings.ToLower(s)), " ")
+	}
+	name = normalize(name)
+
+	var newest *Image
+	for i := range images {
+		image := &images[i]
+		if image.OsType != "Linux" {
+			continue
+		}
+		if !strings.Contains(normalize(image.OsName), name) && !strings.Contains(normalize(image.Name), name) {
+			continue
+		}
+		if newest == nil || image.CreateTime > newest.CreateTime {
+			newest = image
+		}
+	}
+
+	return newest
+}
+
+// levenshtein get the edit distance between a and b
+func levenshtein(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	prev := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+
+	for i := 1; i <= len(ra); i++ {
+		cur := make([]int, len(rb)+1)
+		cur[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			cur[j] = prev[j-1] + cost
+			if prev[j]+1 < cur[j] {
+				cur[j] = prev[j] + 1
+			}
+			if cur[j-1]+1 < cur[j] {
+				cur[j] = cur[j-1] + 1
+			}
+		}
+		prev = cur
+	}
+
+	return prev[len(rb)]
+}
+
+// hostname convert the machine name to a valid hostname, which contains at
+// most 63 lower case letters, digits and hyphens, and does not start or end
+// with a hyphen
+func hostname(name string) string {
+	var b []rune
+	for _, c := range strings.ToLower(name) {
+		switch {
+		case c >= 'a' && c <= 'z', c >= '0' && c <= '9':
+			b = append(b, c)
+		default:
+			b = append(b, '-')
+		}
+	}
+
+	h := string(b)
+	if len(h) > 63 {
+		h = h[:63]
+	}
+
+	return strings.Trim(h, "-")
+}
+
+var passwordCharsets = [][]rune{
+	[]rune("abcdefghijklmnopqrstuvwxyz"),
+	[]rune("ABCDEFGHIJKLMNOPQRSTUVWXYZ"),
+	[]rune("0123456789"),
+	[]rune("~!@#$%^&*()_+}{:?><"),
+}
+
+// generateRandomPassword generate a password of length n which contains lower
+// case letters, upper case letters, digits and special characters, as UCloud
+// requires at least two kinds of characters in password. It is the root
+// password of the uhost, so the characters are picked from crypto/rand.
+func generateRandomPassword(n int) (string, error) {
+	var letters []rune
+	for _, charset := range passwordCharsets {
+		letters = append(letters, charset...)
+	}
 
 	b := make([]rune, n)
 	for i := range b {
-		b[i] = letters[rand.Intn(len(letters))]
+		charset := letters
+		if i < len(passwordCharsets) {
+			charset = passwordCharsets[i]
+		}
+		k, err := randomInt(len(charset))
+		if err != nil {
+			return "", err
+		}
+		b[i] = charset[k]
+	}
+
+	for i := range b {
+		j, err := randomInt(i + 1)
+		if err != nil {
+			return "", err
+		}
+		b[i], b[j] = b[j], b[i]
+	}
+
+	return string(b), nil
+}
+
+// randomInt get a uniform random int in [0, n) from crypto/rand
+func randomInt(n int) (int, error) {
+	k, err := rand.Int(rand.Reader, big.NewInt(int64(n)))
+	if err != nil {
+		return 0, fmt.Errorf("generate random number failed:%w", err)
+	}
+
+	return int(k.Int64()), nil
+}
+
+// cloudConfig get the cloud-init user data which runs the commands at boot
+func cloudConfig(commands []string) string {
+	userdata := "#cloud-config\nruncmd:\n"
+	for _, command := range commands {
+		userdata += "  - |\n    " + command + "\n"
+	}
+
+	return userdata
+}
+
+// sshPortCommand get the command which reconfigures sshd to listen on the
+// port, the SELinux port label is also added on CentOS
+func sshPortCommand(port int) string {
+	return fmt.Sprintf("sed -i -e '/^#\\?Port /d' -e '$a Port %d' /etc/ssh/sshd_config; "+
+		"(semanage port -a -t ssh_port_t -p tcp %d || true); "+
+		"systemctl restart sshd || service sshd restart || service ssh restart", port, port)
+}
+
+// umonAgentCommand get the command which installs and enables the UMon agent
+// with the install script at url, the script is only fetched over HTTPS
+func umonAgentCommand(url string) string {
+	return fmt.Sprintf("curl -fsSL --proto '=https' '%s' | sh", url)
+}
+
+// dockerInstallURL get the install script of Docker, the official script is
+// used in cn-* regions if it is not set, none disables it
+func dockerInstallURL(url, region string) string {
+	if url == "none" {
+		return ""
 	}
+	if url == "" && strings.HasPrefix(region, "cn-") {
+		return officialDockerInstallURL
+	}
+
+	return url
+}
+
+// dockerInstallCommand get the command running the install script, the
+// official script installs the packages of the uhost architecture from the
+// Aliyun mirror in cn-* regions. The script is only fetched over HTTPS.
+func dockerInstallCommand(url, region string) string {
+	if url == officialDockerInstallURL && strings.HasPrefix(region, "cn-") {
+		return fmt.Sprintf("curl -fsSL --proto '=https' '%s' | sh -s -- --mirror Aliyun", url)
+	}
+
+	return fmt.Sprintf("curl -fsSL --proto '=https' '%s' | sh", url)
+}
 
-	return string(b)
+// subnetInNetworks check whether the subnet with netmask is inside one of
+// the CIDR blocks of VPC
+func subnetInNetworks(networks []string, subnet string, netmask int) bool {
+	ip := net.ParseIP(subnet)
+	if ip == nil {
+		return false
+	}
+
+	for _, network := range networks {
+		_, block, err := net.ParseCIDR(network)
+		if err != nil {
+			continue
+		}
+		ones, _ := block.Mask.Size()
+		if block.Contains(ip) && ones <= netmask {
+			return true
+		}
+	}
+
+	return false
+}
+
+// bootstrapUser get the user whose password is set by UCloud, the Ubuntu
+// and Debian images disable the root login and set the password for ubuntu
+// and debian
+func bootstrapUser(osName string) string {
+	osName = strings.ToLower(osName)
+	for _, user := range []string{"ubuntu", "debian"} {
+		if strings.Contains(osName, user) {
+			return user
+		}
+	}
+
+	return "root"
+}
+
+// sudoCommand run the command as root if user is not root, the command is
+// encoded to avoid quoting it again
+func sudoCommand(user, command string) string {
+	if user == "root" {
+		return command
+	}
+
+	return fmt.Sprintf("echo %s | base64 -d | sudo -H sh", base64.StdEncoding.EncodeToString([]byte(command)))
+}
+
+// rootCommand run the command with sh as root, unlike sudoCommand it does not
+// depend on the login shell of root
+func rootCommand(user, command string) string {
+	if user == "root" {
+		return fmt.Sprintf("echo %s | base64 -d | sh", base64.StdEncoding.EncodeToString([]byte(command)))
+	}
+
+	return sudoCommand(user, command)
+}
+
+// appendKeyCommand get the command appending the public key to the file if
+// the file does not have it
+func appendKeyCommand(publicKey, file string) string {
+	return fmt.Sprintf("(grep -qxF '%s' %s 2>/dev/null || echo '%s' >> %s)", publicKey, file, publicKey, file)
+}
+
+// validateSSHUser validate the name of linux user
+func validateSSHUser(user string) error {
+	if !sshUserRegexp.MatchString(user) {
+		return errInvalidSSHUser
+	}
+
+	return nil
+}
+
+// authorizedKeysCommand get the command to install the public key for user,
+// the non-root user is created with sudo and docker permissions. The key is
+// appended only if it is not in authorized_keys, so the command can be rerun.
+func authorizedKeysCommand(user, publicKey string) string {
+	publicKey = strings.TrimSpace(publicKey)
+	if user == "root" {
+		return fmt.Sprintf("mkdir -p ~/.ssh; %s", appendKeyCommand(publicKey, "~/.ssh/authorized_keys"))
+	}
+
+	return strings.Join(append(userSetupCommands(user),
+		fmt.Sprintf("mkdir -p ~%s/.ssh", user),
+		appendKeyCommand(publicKey, fmt.Sprintf("~%s/.ssh/authorized_keys", user)),
+		fmt.Sprintf("chmod 700 ~%s/.ssh && chmod 600 ~%s/.ssh/authorized_keys", user, user),
+		fmt.Sprintf("chown -R %s:%s ~%s/.ssh", user, user, user),
+	), "; ")
+}
+
+// authorizedKeysFileCommand get the command to install the public key in
+// keyFile for user, it is like authorizedKeysCommand but the key is never
+// quoted by shell. authorized_keys is replaced by rename and keyFile is
+// removed at last.
+func authorizedKeysFileCommand(user, keyFile string) string {
+	home := "~" + user
+	if user == "root" {
+		home = "/root"
+	}
+	file := home + "/.ssh/authorized_keys"
+
+	commands := userSetupCommands(user)
+	if user == "root" {
+		commands = nil
+	}
+
+	return strings.Join(append(commands,
+		fmt.Sprintf("mkdir -p %s/.ssh && touch %s", home, file),
+		fmt.Sprintf("(grep -qxFf '%s' %s || (awk 1 %s '%s' > %s.tmp && mv -f %s.tmp %s))", keyFile, file, file, keyFile, file, file, file),
+		fmt.Sprintf("chmod 700 %s/.ssh && chmod 600 %s", home, file),
+		fmt.Sprintf("chown -R %s:%s %s/.ssh", user, user, home),
+		fmt.Sprintf("rm -f '%s'", keyFile),
+	), "; ")
+}
+
+// userSetupCommands get the commands creating the non-root user with sudo and
+// docker permissions
+func userSetupCommands(user string) []string {
+	return []string{
+		fmt.Sprintf("id -u %s >/dev/null 2>&1 || useradd -m -s /bin/bash %s", user, user),
+		"(getent group docker >/dev/null || groupadd docker)",
+		fmt.Sprintf("usermod -aG docker %s", user),
+		fmt.Sprintf("echo '%s ALL=(ALL) NOPASSWD:ALL' > /etc/sudoers.d/90-docker-machine-%s", user, user),
+		fmt.Sprintf("chmod 0440 /etc/sudoers.d/90-docker-machine-%s", user),
+	}
 }
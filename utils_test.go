@@ -0,0 +1,314 @@
+package ucloud
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestValidateUCloudZone(t *testing.T) {
+	zones := []string{"cn-bj2-02", "cn-bj2-03"}
+
+	if err := validateUCloudZone("cn-bj2-03", zones); err != nil {
+		t.Errorf("validate zone failed:%s", err)
+	}
+
+	if err := validateUCloudZone("cn-bj2-01", zones); err != errInvalidZone {
+		t.Errorf("expected error:%s, got:%v", errInvalidZone, err)
+	}
+}
+
+func TestGenerateRandomPassword(t *testing.T) {
+	password, err := generateRandomPassword(16)
+	if err != nil {
+		t.Fatalf("generate password failed:%s", err)
+	}
+	if len(password) != 16 {
+		t.Errorf("expected password length:16, got:%d", len(password))
+	}
+
+	for _, charset := range passwordCharsets {
+		if !strings.ContainsAny(password, string(charset)) {
+			t.Errorf("password:%s does not contain any of:%s", password, string(charset))
+		}
+	}
+}
+
+func TestValidateSecurityGroupRule(t *testing.T) {
+	valid := []string{
+		"TCP|22|0.0.0.0/0|ACCEPT|50",
+		"UDP|8000-8080|10.0.0.0/8|DROP|100",
+		"ICMP||0.0.0.0/0|ACCEPT|150",
+	}
+	for _, rule := range valid {
+		if err := validateSecurityGroupRule(rule); err != nil {
+			t.Errorf("validate rule:%s failed:%s", rule, err)
+		}
+	}
+
+	invalid := []string{
+		"TCP|22|0.0.0.0/0|ACCEPT",
+		"HTTP|80|0.0.0.0/0|ACCEPT|50",
+		"TCP|70000|0.0.0.0/0|ACCEPT|50",
+		"TCP|22|0.0.0.0|ACCEPT|50",
+		"TCP|22|0.0.0.0/0|REJECT|50",
+		"TCP|22|0.0.0.0/0|ACCEPT|10",
+	}
+	for _, rule := range invalid {
+		if err := validateSecurityGroupRule(rule); err != errInvalidRule {
+			t.Errorf("expected error:%s for rule:%s, got:%v", errInvalidRule, rule, err)
+		}
+	}
+}
+
+func TestClosestImages(t *testing.T) {
+	images := []Image{
+		{Id: "uimage-1", OsName: "Ubuntu 14.04 64位"},
+		{Id: "uimage-2", OsName: "CentOS 7.0 64位"},
+		{Id: "uimage-3", OsName: "CentOS 6.5 64位"},
+	}
+
+	closest := closestImages("centos 7.0 64位", images, 2)
+	if len(closest) != 2 {
+		t.Fatalf("expected 2 images, got:%d", len(closest))
+	}
+	if closest[0].Id != "uimage-2" || closest[1].Id != "uimage-3" {
+		t.Errorf("expected uimage-2 and uimage-3, got:%+v", closest)
+	}
+}
+
+func TestHostname(t *testing.T) {
+	cases := map[string]string{
+		"ucloud-machine":        "ucloud-machine",
+		"My_Machine.01":         "my-machine-01",
+		"-docker-machine-":      "docker-machine",
+		strings.Repeat("a", 70): strings.Repeat("a", 63),
+	}
+
+	for name, expected := range cases {
+		if h := hostname(name); h != expected {
+			t.Errorf("expected hostname:%s for name:%s, got:%s", expected, name, h)
+		}
+	}
+}
+
+func TestCloudConfig(t *testing.T) {
+	userdata := cloudConfig([]string{sshPortCommand(2222)})
+	if !strings.HasPrefix(userdata, "#cloud-config\nruncmd:\n  - |\n    sed ") {
+		t.Errorf("user data should be a cloud config, got:%s", userdata)
+	}
+	if !strings.Contains(userdata, "Port 2222") {
+		t.Errorf("user data should set the port 2222, got:%s", userdata)
+	}
+}
+
+func TestAuthorizedKeysCommand(t *testing.T) {
+	if err := validateSSHUser("ubuntu"); err != nil {
+		t.Errorf("ubuntu should be a valid user, got:%s", err)
+	}
+	if err := validateSSHUser("bad user;"); err != errInvalidSSHUser {
+		t.Errorf("expected errInvalidSSHUser, got:%v", err)
+	}
+
+	command := authorizedKeysCommand("root", "ssh-rsa AAAA\n")
+	if command != "mkdir -p ~/.ssh; (grep -qxF 'ssh-rsa AAAA' ~/.ssh/authorized_keys 2>/dev/null || echo 'ssh-rsa AAAA' >> ~/.ssh/authorized_keys)" {
+		t.Errorf("unexpected command for root:%s", command)
+	}
+
+	command = authorizedKeysCommand("ubuntu", "ssh-rsa AAAA")
+	for _, part := range []string{"useradd -m -s /bin/bash ubuntu", "usermod -aG docker ubuntu", "/etc/sudoers.d/", "~ubuntu/.ssh/authorized_keys"} {
+		if !strings.Contains(command, part) {
+			t.Errorf("command should contain %q, got:%s", part, command)
+		}
+	}
+}
+
+func TestAuthorizedKeysFileCommand(t *testing.T) {
+	command := authorizedKeysFileCommand("ubuntu", "/home/ubuntu/.docker-machine-key.pub")
+	for _, part := range []string{"useradd -m -s /bin/bash ubuntu", "grep -qxFf '/home/ubuntu/.docker-machine-key.pub' ~ubuntu/.ssh/authorized_keys", "mv -f ~ubuntu/.ssh/authorized_keys.tmp ~ubuntu/.ssh/authorized_keys", "rm -f '/home/ubuntu/.docker-machine-key.pub'"} {
+		if !strings.Contains(command, part) {
+			t.Errorf("command should contain %q, got:%s", part, command)
+		}
+	}
+
+	command = authorizedKeysFileCommand("root", "/home/ubuntu/.docker-machine-key.pub")
+	if strings.Contains(command, "useradd") || !strings.Contains(command, "/root/.ssh/authorized_keys") {
+		t.Errorf("unexpected command for root:%s", command)
+	}
+}
+
+func TestError(t *testing.T) {
+	err := fmt.Errorf("pre-create check failed:%w", newError(ErrQuotaExceeded, "EIP quota exceeded in region %s", "cn-north-03"))
+	if !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("the cause should be ErrQuotaExceeded, got:%s", err)
+	}
+	if errors.Is(err, ErrNoStock) {
+		t.Errorf("the cause should not be ErrNoStock")
+	}
+	if err.Error() != "pre-create check failed:EIP quota exceeded in region cn-north-03" {
+		t.Errorf("unexpected message:%s", err)
+	}
+}
+
+func TestCreateUHostError(t *testing.T) {
+	d := NewDriver("ucloud-machine", "")
+	if err := d.createUHostError(retCodeError(retCodeNoStock)); !errors.Is(err, ErrNoStock) {
+		t.Errorf("the sold out response should be ErrNoStock, got:%v", err)
+	}
+	if err := d.createUHostError(fmt.Errorf("create failed:%w", retCodeError(retCodeNoStock))); !errors.Is(err, ErrNoStock) {
+		t.Errorf("the wrapped sold out response should be ErrNoStock, got:%v", err)
+	}
+	if err := d.createUHostError(retCodeError(230)); errors.Is(err, ErrNoStock) {
+		t.Errorf("the other response should not be ErrNoStock, got:%v", err)
+	}
+}
+
+func TestDockerInstallURL(t *testing.T) {
+	cases := []struct {
+		url, region, expected string
+	}{
+		{"", "cn-north-03", officialDockerInstallURL},
+		{"", "us-west-01", ""},
+		{"none", "cn-north-03", ""},
+		{"https://example.com/docker.sh", "cn-north-03", "https://example.com/docker.sh"},
+	}
+
+	for _, c := range cases {
+		if url := dockerInstallURL(c.url, c.region); url != c.expected {
+			t.Errorf("expected %q for url:%q region:%s, got %q", c.expected, c.url, c.region, url)
+		}
+	}
+
+	if cmd := dockerInstallCommand(officialDockerInstallURL, "cn-bj2"); cmd != "curl -fsSL --proto '=https' 'https://get.docker.com' | sh -s -- --mirror Aliyun" {
+		t.Errorf("unexpected install command:%s", cmd)
+	}
+}
+
+func TestImageArch(t *testing.T) {
+	cases := []struct {
+		osName, name, expected string
+	}{
+		{"CentOS 7.9 64位", "CentOS 7.9 64位", archX86},
+		{"Ubuntu 22.04 aarch64", "", archARM},
+		{"Ubuntu 22.04", "ubuntu-22.04-ARM64", archARM},
+	}
+
+	for _, c := range cases {
+		if arch := imageArch(c.osName, c.name); arch != c.expected {
+			t.Errorf("expected %s for image %q, got %s", c.expected, c.osName, arch)
+		}
+	}
+}
+
+func TestNewestImage(t *testing.T) {
+	images := []Image{
+		{Id: "uimage-1", OsType: "Linux", OsName: "Ubuntu 22.04 64位", CreateTime: 100},
+		{Id: "uimage-2", OsType: "Linux", OsName: "Ubuntu  22.04 64位", CreateTime: 200},
+		{Id: "uimage-3", OsType: "Linux", OsName: "CentOS 7.9 64位", CreateTime: 300},
+		{Id: "uimage-4", OsType: "Windows", OsName: "Ubuntu 22.04 Windows", CreateTime: 400},
+	}
+
+	if image := newestImage("ubuntu 22.04", images); image == nil || image.Id != "uimage-2" {
+		t.Errorf("expected uimage-2, got:%+v", image)
+	}
+	if image := newestImage("Debian", images); image != nil {
+		t.Errorf("expected no image, got:%+v", image)
+	}
+}
+
+func TestSudoCommand(t *testing.T) {
+	if user := bootstrapUser("Ubuntu 22.04 64位"); user != "ubuntu" {
+		t.Errorf("expected ubuntu for Ubuntu image, got:%s", user)
+	}
+	if user := bootstrapUser("Debian 12.0 64位"); user != "debian" {
+		t.Errorf("expected debian for Debian image, got:%s", user)
+	}
+	if user := bootstrapUser("CentOS 7.9 64位"); user != "root" {
+		t.Errorf("expected root for CentOS image, got:%s", user)
+	}
+
+	if command := sudoCommand("root", "echo 'a'"); command != "echo 'a'" {
+		t.Errorf("command of root should not be changed, got:%s", command)
+	}
+	if command := sudoCommand("ubuntu", "echo 'a'"); command != "echo ZWNobyAnYSc= | base64 -d | sudo -H sh" {
+		t.Errorf("unexpected command:%s", command)
+	}
+}
+
+func TestEIPOperator(t *testing.T) {
+	cases := []struct {
+		operator, region, expected string
+	}{
+		{"", "cn-bj2", "Bgp"},
+		{"", "hk", "International"},
+		{"", "us-ca", "International"},
+		{"Telecom", "cn-sh2", "Telecom"},
+	}
+	for _, c := range cases {
+		if operator := eipOperator(c.operator, c.region); operator != c.expected {
+			t.Errorf("expected operator %s of %s, got %s", c.expected, c.region, operator)
+		}
+	}
+
+	if err := validateEIPOperator("Cmcc"); err != errInvalidEIPOperator {
+		t.Errorf("expected error:%s, got:%v", errInvalidEIPOperator, err)
+	}
+}
+
+func TestOpenPortRule(t *testing.T) {
+	for _, port := range []string{"8080/icmp", "80000/tcp", "http", ""} {
+		if _, err := openPortRule(port); err != errInvalidOpenPort {
+			t.Errorf("expected error:%s of port %q, got:%v", errInvalidOpenPort, port, err)
+		}
+	}
+}
+
+func TestValidateUCloudRegion(t *testing.T) {
+	for region, expected := range map[string]string{
+		"cn-bj2":      "cn-bj2",
+		"cn-north-03": "cn-bj2",
+		"hk-01":       "hk",
+	} {
+		if r, err := validateUCloudRegion(region); err != nil || r != expected {
+			t.Errorf("expected region %s of %s, got %s, err:%v", expected, region, r, err)
+		}
+	}
+
+	if _, err := validateUCloudRegion("cn-north-99"); err != errInvalidRegion {
+		t.Errorf("expected error:%s, got:%v", errInvalidRegion, err)
+	}
+	if _, deprecated := canonicalRegion("cn-bj2"); deprecated {
+		t.Errorf("cn-bj2 should not be deprecated")
+	}
+}
+
+func TestMonthlyPrice(t *testing.T) {
+	cases := []struct {
+		price      float64
+		chargeType string
+		expected   float64
+	}{
+		{0.5, "Dynamic", 360},
+		{1200, "Year", 100},
+		{100, "Month", 100},
+		{100, "Trial", 0},
+	}
+	for _, c := range cases {
+		if price := monthlyPrice(c.price, c.chargeType); price != c.expected {
+			t.Errorf("expected monthly price %v of %v %s, got %v", c.expected, c.price, c.chargeType, price)
+		}
+	}
+}
+
+func TestSubnetInNetworks(t *testing.T) {
+	if !subnetInNetworks([]string{"192.168.0.0/16", "10.10.0.0/16"}, "10.10.0.0", 24) {
+		t.Errorf("the subnet should be in 10.10.0.0/16")
+	}
+	if subnetInNetworks([]string{"192.168.0.0/16"}, "10.10.0.0", 24) {
+		t.Errorf("the subnet should not be in 192.168.0.0/16")
+	}
+	if subnetInNetworks([]string{"10.10.0.0/25"}, "10.10.0.0", 24) {
+		t.Errorf("the subnet should not fit in the smaller block 10.10.0.0/25")
+	}
+}